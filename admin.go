@@ -17,6 +17,7 @@
 package main
 
 import (
+	"context"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -24,8 +25,10 @@ import (
 	"net/http"
 	"os"
 	"path/filepath"
+	"strconv"
 	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-playground/webhooks/v6/github"
 
@@ -66,14 +69,318 @@ func writeKey(key, path, name string) (string, error) {
 	return path, nil
 }
 
-func createMirror(w http.ResponseWriter, r *http.Request) {
-	if r.Method != http.MethodPost {
+func checkAdminRequest(w http.ResponseWriter, r *http.Request, methods ...string) bool {
+	methodOK := false
+	for _, method := range methods {
+		if r.Method == method {
+			methodOK = true
+			break
+		}
+	}
+	if !methodOK {
 		respondErr(w, r, github.ErrInvalidHTTPMethod, http.StatusBadRequest)
-		return
+		return false
 	}
 	header := r.Header.Get("Authorization")
-	if config.Server.AdminSecret != "" && header != "Bearer "+config.Server.AdminSecret {
+	if config.Server.AdminSecret.Value != "" && header != "Bearer "+config.Server.AdminSecret.Value {
 		respondErr(w, r, ErrInvalidAdminSecret, http.StatusUnauthorized)
+		return false
+	}
+	return true
+}
+
+func respondJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(data)
+}
+
+func listRunningJobs(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet) {
+		return
+	}
+	respondJSON(w, http.StatusOK, listJobs())
+}
+
+func cancelRunningJob(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodPost) {
+		return
+	}
+	name := r.URL.Query().Get("repo")
+	if !cancelJob(name) {
+		respondErr(w, r, fmt.Errorf("no running job for %s", name), http.StatusNotFound)
+		return
+	}
+	log.Infofln("Canceled running mirror job for %s (requested by %s)", name, readUserIP(r))
+	w.WriteHeader(http.StatusOK)
+}
+
+func (repo Repository) redacted() Repository {
+	repo.Secret = repo.Secret.Redacted()
+	repo.CISecret = repo.CISecret.Redacted()
+	return repo
+}
+
+func (repo *CIRepository) redacted() *CIRepository {
+	return &CIRepository{
+		Secret:         repo.Secret.Redacted(),
+		StatusToken:    repo.StatusToken.Redacted(),
+		Owner:          repo.Owner,
+		Name:           repo.Name,
+		Mode:           repo.Mode,
+		InstallationID: repo.InstallationID,
+		GitHubToken:    repo.GitHubToken.Redacted(),
+		GiteaURL:       repo.GiteaURL,
+		GiteaToken:     repo.GiteaToken.Redacted(),
+		GitLabURL:      repo.GitLabURL,
+		GitLabToken:    repo.GitLabToken.Redacted(),
+
+		PipelineCheckName:     repo.PipelineCheckName,
+		LogExcerptLines:       repo.LogExcerptLines,
+		TestReportAnnotations: repo.TestReportAnnotations,
+		PRComment:             repo.PRComment,
+		Deployments:           repo.Deployments,
+		Jobs:                  repo.Jobs,
+		Output:                repo.Output,
+	}
+}
+
+func listMirrors(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet) {
+		return
+	}
+	allRepos := getRepositories()
+	repos := make(map[string]Repository, len(allRepos))
+	for name, repo := range allRepos {
+		repos[name] = repo.redacted()
+	}
+	respondJSON(w, http.StatusOK, repos)
+}
+
+func getOrDeleteMirror(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet, http.MethodDelete) {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	repo, ok := getRepository(name)
+	if !ok {
+		respondErr(w, r, fmt.Errorf("unknown repository %s", name), http.StatusNotFound)
+		return
+	}
+	if r.Method == http.MethodDelete {
+		log.Infofln("Removing %s from repos (requested by %s)", name, readUserIP(r))
+		if err := deleteRepository(name); err != nil {
+			respondErr(w, r, err, http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusOK)
+	} else {
+		respondJSON(w, http.StatusOK, repo.redacted())
+	}
+}
+
+func syncMirror(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodPost) {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	repo, ok := getRepository(name)
+	if !ok {
+		respondErr(w, r, fmt.Errorf("unknown repository %s", name), http.StatusNotFound)
+		return
+	}
+	log.Infofln("Manual sync of %s requested by %s", name, readUserIP(r))
+	res := syncRepository(repo, fmt.Sprintf("git://github.com/%s.git", repo.Name))
+	recordRun(repo, "manual", res)
+	respondJSON(w, res.StatusCode, res)
+}
+
+func listRuns(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet) {
+		return
+	}
+	name := r.URL.Query().Get("name")
+	if _, ok := getRepository(name); !ok {
+		respondErr(w, r, fmt.Errorf("unknown repository %s", name), http.StatusNotFound)
+		return
+	}
+	runs, err := getRunHistory(name)
+	if err != nil {
+		respondErr(w, r, fmt.Errorf("failed to read run history: %w", err), http.StatusInternalServerError)
+		return
+	} else if runs == nil {
+		runs = []json.RawMessage{}
+	}
+	respondJSON(w, http.StatusOK, runs)
+}
+
+func getMetrics(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet) {
+		return
+	}
+	respondJSON(w, http.StatusOK, map[string]interface{}{
+		"ci_cache":   getCICacheMetrics(),
+		"github_api": getGitHubAPIMetrics(),
+	})
+}
+
+func listDeliveries(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet) {
+		return
+	}
+	deliveries, err := getDeliveries()
+	if err != nil {
+		respondErr(w, r, fmt.Errorf("failed to read webhook deliveries: %w", err), http.StatusInternalServerError)
+		return
+	} else if deliveries == nil {
+		deliveries = []json.RawMessage{}
+	}
+	respondJSON(w, http.StatusOK, deliveries)
+}
+
+func createCIMirror(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodPost) {
+		return
+	}
+	projectID, err := strconv.ParseInt(r.URL.Query().Get("project_id"), 10, 64)
+	if err != nil {
+		respondErr(w, r, fmt.Errorf("invalid project ID: %w", err), http.StatusBadRequest)
+		return
+	}
+	var ciRepo CIRepository
+	if data, err := io.ReadAll(r.Body); err != nil {
+		respondErr(w, r, github.ErrParsingPayload, http.StatusBadRequest)
+		return
+	} else if err = json.Unmarshal(data, &ciRepo); err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	} else if ciRepo.Owner == "" || ciRepo.Name == "" {
+		respondErr(w, r, errors.New("owner and repo are required"), http.StatusBadRequest)
+		return
+	} else if err = ciRepo.checkMode(); err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	} else if err = ciRepo.compile(); err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	}
+	initCIRepository(&ciRepo)
+	if err = putCIRepository(projectID, &ciRepo); err != nil {
+		respondErr(w, r, err, http.StatusInternalServerError)
+		return
+	}
+	log.Infofln("Added CI repository %d to mirror status to %s/%s (requested by %s)", projectID, ciRepo.Owner, ciRepo.Name, readUserIP(r))
+	respondJSON(w, http.StatusOK, &ciRepo)
+}
+
+func reconcileCIMirrors(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodPost) {
+		return
+	}
+	var projectID int64
+	if rawProjectID := r.URL.Query().Get("project_id"); len(rawProjectID) > 0 {
+		var err error
+		if projectID, err = strconv.ParseInt(rawProjectID, 10, 64); err != nil {
+			respondErr(w, r, fmt.Errorf("invalid project ID: %w", err), http.StatusBadRequest)
+			return
+		} else if _, ok := getCIRepository(projectID); !ok {
+			respondErr(w, r, fmt.Errorf("unknown CI repository %d", projectID), http.StatusNotFound)
+			return
+		}
+	}
+	window := reconcileWindow()
+	if rawSince := r.URL.Query().Get("since"); len(rawSince) > 0 {
+		var err error
+		if window, err = time.ParseDuration(rawSince); err != nil {
+			respondErr(w, r, fmt.Errorf("invalid since duration: %w", err), http.StatusBadRequest)
+			return
+		}
+	}
+	log.Infofln("CI reconciliation of the last %s requested by %s", window, readUserIP(r))
+	respondJSON(w, http.StatusOK, reconcileCIRepositories(time.Now().Add(-window), projectID))
+}
+
+// initCIRepository fills the defaults and runtime fields of a new CI repository.
+func initCIRepository(ciRepo *CIRepository) {
+	if len(ciRepo.Secret.Value) == 0 {
+		ciRepo.Secret = Secret{Value: RandString(50)}
+	}
+	ciRepo.plock = NewPartitionLocker(&sync.Mutex{})
+	if ciRepo.InstallationID == 0 && appGHClient != nil {
+		installation, _, err := appGHClient.Apps.FindRepositoryInstallation(context.Background(), ciRepo.Owner, ciRepo.Name)
+		if err != nil {
+			log.Warnfln("Failed to find installation ID for %s/%s: %v", ciRepo.Owner, ciRepo.Name, err)
+		} else {
+			ciRepo.InstallationID = installation.GetID()
+		}
+	}
+}
+
+type HostKeyList struct {
+	Known   []HostKey            `json:"known"`
+	Pending map[string][]HostKey `json:"pending"`
+}
+
+func listHostKeys(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodGet) {
+		return
+	}
+	knownHostsLock.Lock()
+	known, _, err := readKnownHosts()
+	knownHostsLock.Unlock()
+	if err != nil {
+		respondErr(w, r, fmt.Errorf("failed to read known_hosts: %w", err), http.StatusInternalServerError)
+		return
+	}
+	respondJSON(w, http.StatusOK, &HostKeyList{Known: known, Pending: getPendingHostKeys()})
+}
+
+type ApproveHostKeyRequest struct {
+	Host string `json:"host"`
+	// Key type to approve. If empty, all pending keys of the host are approved.
+	Type string `json:"type"`
+	// Explicit key to add. If empty, the pending keys found during a failed run are approved.
+	Key string `json:"key"`
+}
+
+func approveHostKeys(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodPost) {
+		return
+	}
+	var req ApproveHostKeyRequest
+	if data, err := io.ReadAll(r.Body); err != nil {
+		respondErr(w, r, github.ErrParsingPayload, http.StatusBadRequest)
+		return
+	} else if err = json.Unmarshal(data, &req); err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	} else if req.Host == "" {
+		respondErr(w, r, errors.New("host is required"), http.StatusBadRequest)
+		return
+	}
+
+	var approved []HostKey
+	var err error
+	if req.Key != "" {
+		if req.Type == "" {
+			respondErr(w, r, errors.New("type is required when specifying a key"), http.StatusBadRequest)
+			return
+		}
+		approved = []HostKey{{Host: req.Host, Type: req.Type, Key: req.Key}}
+		err = addHostKeys(approved...)
+	} else {
+		approved, err = approvePendingHostKeys(req.Host, req.Type)
+	}
+	if err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	}
+	log.Infofln("%s approved %d host keys for %s", readUserIP(r), len(approved), req.Host)
+	respondJSON(w, http.StatusOK, approved)
+}
+
+func createMirror(w http.ResponseWriter, r *http.Request) {
+	if !checkAdminRequest(w, r, http.MethodPost) {
 		return
 	}
 
@@ -92,12 +399,13 @@ func createMirror(w http.ResponseWriter, r *http.Request) {
 
 	log.Debugln("Create mirror request from %s: %s to %s", readUserIP(r), repo.Name, repo.Target)
 
-	log.Infoln("Adding", repo.Name, "with push target", repo.Target, "to repos")
-	config.Repositories[repo.Name] = repo
-
 	var err error
 	if req.GitHubToken != "" {
-		repo.Secret, err = CreateGitHubWebhook(req.GitHubToken, repo.Name, repo.Secret)
+		events := []string{"push"}
+		if repo.MirrorWiki {
+			events = append(events, "gollum")
+		}
+		repo.Secret.Value, err = CreateGitHubWebhook(req.GitHubToken, repo.Name, repo.Secret.Value, events)
 		if err != nil {
 			respondErr(w, r, err, http.StatusInternalServerError)
 			return
@@ -111,15 +419,16 @@ func createMirror(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	var ciRepo *CIRepository
 	if appGHClient != nil && req.GitLabProjectID != 0 && req.GitLabToken != "" && req.GitLabURL != "" {
 		parts := strings.Split(repo.Name, "/")
-		ciRepo := &CIRepository{
-			Secret:        RandString(50),
-			Owner:         parts[0],
-			Name:          parts[1],
-			plock:         NewPartitionLocker(&sync.Mutex{}),
-			checkSuiteIDs: make(map[string]int64),
-			checkRunIDs:   make(map[int64]int64),
+		ciRepo = &CIRepository{
+			Secret:      Secret{Value: RandString(50)},
+			Owner:       parts[0],
+			Name:        parts[1],
+			GitLabURL:   req.GitLabURL,
+			GitLabToken: Secret{Value: req.GitLabToken},
+			plock:       NewPartitionLocker(&sync.Mutex{}),
 		}
 		installation, _, err := appGHClient.Apps.FindRepositoryInstallation(r.Context(), ciRepo.Owner, ciRepo.Name)
 		if err != nil {
@@ -130,18 +439,24 @@ func createMirror(w http.ResponseWriter, r *http.Request) {
 		ciRepo.InstallationID = installation.GetID()
 
 		log.Debugln("Creating CI webhook for", req.GitLabProjectID)
-		err = CreateGitLabWebhook(req.GitLabURL, req.GitLabToken, req.GitLabProjectID, ciRepo.Secret)
+		err = CreateGitLabWebhook(req.GitLabURL, req.GitLabToken, req.GitLabProjectID, ciRepo.Secret.Value)
 		if err != nil {
 			respondErr(w, r, fmt.Errorf("failed to create CI webhook: %w", err), http.StatusInternalServerError)
 			return
 		}
 		log.Infofln("Successfully created CI webhook for %d to mirror status to %s/%s", req.GitLabProjectID, ciRepo.Owner, ciRepo.Name)
-
-		config.CIRepositories[req.GitLabProjectID] = ciRepo
 	}
 
-	log.Debugln("Saving config...")
-	saveConfig()
+	log.Infoln("Adding", repo.Name, "with push target", repo.Target, "to repos")
+	if err = putRepository(repo); err != nil {
+		respondErr(w, r, err, http.StatusInternalServerError)
+		return
+	} else if ciRepo != nil {
+		if err = putCIRepository(req.GitLabProjectID, ciRepo); err != nil {
+			respondErr(w, r, err, http.StatusInternalServerError)
+			return
+		}
+	}
 
 	w.WriteHeader(http.StatusOK)
 }
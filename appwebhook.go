@@ -0,0 +1,207 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// Identifier of the requested action on check runs of manual jobs.
+const playJobAction = "play"
+
+var ErrNoCIRepository = errors.New("no CI repository with the GitLab API configured found for the GitHub repository")
+
+// findCIRepositories returns the CI repositories that mirror to the given GitHub repo through the given installation
+// and have the GitLab API configured, ordered by GitLab project ID.
+func findCIRepositories(fullName string, installationID int64) []*CIRepository {
+	var repos []*CIRepository
+	for _, repo := range getCIRepositories() {
+		if repo.usesCommitStatuses() || !strings.EqualFold(repo.Owner+"/"+repo.Name, fullName) || (installationID != 0 && repo.InstallationID != installationID) {
+			continue
+		} else if _, err := repo.gitlabClient(); err != nil {
+			continue
+		}
+		repos = append(repos, repo)
+	}
+	sort.Slice(repos, func(i, j int) bool {
+		return repos[i].projectID < repos[j].projectID
+	})
+	return repos
+}
+
+// rerunCheckRun retries the GitLab job or pipeline that the check run was created for.
+func rerunCheckRun(repo *CIRepository, run *github.CheckRun) error {
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		return err
+	}
+	externalID := run.GetExternalID()
+	if strings.HasPrefix(externalID, "status:") {
+		return errors.New("check runs created through the CI status endpoint can't be re-run")
+	} else if strings.HasPrefix(externalID, "pipeline-") {
+		pipelineID, err := strconv.ParseInt(strings.TrimPrefix(externalID, "pipeline-"), 10, 64)
+		if err != nil {
+			return fmt.Errorf("invalid pipeline ID in external ID %q", externalID)
+		}
+		pipeline, err := gl.RetryPipeline(repo.projectID, pipelineID)
+		if err != nil {
+			return fmt.Errorf("failed to retry pipeline %d: %w", pipelineID, err)
+		}
+		log.Infofln("Retried pipeline %d in %d for check run %d in %s/%s, status is now %s", pipelineID, repo.projectID, run.GetID(), repo.Owner, repo.Name, pipeline.Status)
+		return nil
+	}
+	jobID, err := strconv.ParseInt(externalID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid job ID in external ID %q", externalID)
+	}
+	job, err := gl.RetryJob(repo.projectID, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to retry job %d: %w", jobID, err)
+	}
+	log.Infofln("Retried job %d in %d for check run %d in %s/%s, new job ID is %d", jobID, repo.projectID, run.GetID(), repo.Owner, repo.Name, job.ID)
+	return nil
+}
+
+// playManualJob starts the manual GitLab job of a check run and creates a new check run for it.
+func playManualJob(repo *CIRepository, run *github.CheckRun) error {
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		return err
+	}
+	jobID, err := strconv.ParseInt(run.GetExternalID(), 10, 64)
+	if err != nil {
+		return fmt.Errorf("invalid job ID in external ID %q", run.GetExternalID())
+	}
+	job, err := gl.PlayJob(repo.projectID, jobID)
+	if err != nil {
+		return fmt.Errorf("failed to play job %d: %w", jobID, err)
+	}
+	log.Infofln("Started manual job %d in %d for check run %d in %s/%s", jobID, repo.projectID, run.GetID(), repo.Owner, repo.Name)
+	// The old check run is already completed, so make a new one to show that the job is running
+	evt := job.ToEvent(repo.projectID)
+	queueEvent(ciEventKey(repo.projectID, evt.SHA), func() { syncJobCheckRun(repo, evt, true) })
+	return nil
+}
+
+// rerunCheckSuite starts a new GitLab pipeline for the branch of the check suite.
+// GitLab can only create pipelines for refs, so the pipeline will be for the current head of the branch.
+func rerunCheckSuite(repo *CIRepository, suite *github.CheckSuite) error {
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		return err
+	} else if len(suite.GetHeadBranch()) == 0 {
+		return fmt.Errorf("check suite for %s doesn't have a branch", suite.GetHeadSHA())
+	}
+	pipeline, err := gl.CreatePipeline(repo.projectID, suite.GetHeadBranch())
+	if err != nil {
+		return fmt.Errorf("failed to create pipeline for %s: %w", suite.GetHeadBranch(), err)
+	}
+	if pipeline.SHA != suite.GetHeadSHA() {
+		log.Warnfln("Created pipeline %d in %d for %s, but the branch is now at %s instead of %s", pipeline.ID, repo.projectID, suite.GetHeadBranch(), pipeline.SHA, suite.GetHeadSHA())
+	} else {
+		log.Infofln("Created pipeline %d in %d for %s/%s", pipeline.ID, repo.projectID, suite.GetHeadBranch(), pipeline.SHA)
+	}
+	return nil
+}
+
+// tryCIRepositories calls the given function with each CI repository that mirrors to the GitHub repo until one succeeds.
+// Multiple GitLab projects can report to the same GitHub repo, and there's no way to know which one a check belongs to.
+func tryCIRepositories(fullName string, installationID int64, fn func(repo *CIRepository) error) (err error, code int) {
+	repos := findCIRepositories(fullName, installationID)
+	if len(repos) == 0 {
+		return ErrNoCIRepository, http.StatusNotFound
+	}
+	for _, repo := range repos {
+		if err = fn(repo); err == nil {
+			return nil, http.StatusOK
+		}
+		log.Debugfln("Failed to handle GitHub app event for %s with project %d: %v", fullName, repo.projectID, err)
+	}
+	return err, http.StatusBadGateway
+}
+
+func handleAppWebhook(w http.ResponseWriter, r *http.Request) {
+	rec := newDeliveryRecorder(w, "github-app", r.Header.Get("X-GitHub-Delivery"), r.Header.Get("X-GitHub-Event"))
+	w = rec
+	defer rec.save()
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Errorln("Handling GitHub app webhook from", readUserIP(r), "panicked:", err)
+			debug.PrintStack()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	payload, err := github.ValidatePayload(r, []byte(config.GitHubApp.WebhookSecret.Value))
+	if err != nil {
+		respondErr(w, r, err, http.StatusUnauthorized)
+		return
+	}
+	rawEvt, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	switch evt := rawEvt.(type) {
+	case *github.PingEvent:
+		log.Infoln("Received GitHub app webhook ping from", readUserIP(r))
+	case *github.CheckRunEvent:
+		rec.Repository = evt.GetRepo().GetFullName()
+		var handler func(repo *CIRepository, run *github.CheckRun) error
+		if evt.GetAction() == "rerequested" {
+			log.Debugfln("Handling re-run request for check run %d (%s) in %s", evt.GetCheckRun().GetID(), evt.GetCheckRun().GetName(), rec.Repository)
+			handler = rerunCheckRun
+		} else if evt.GetAction() == "requested_action" && evt.GetRequestedAction().Identifier == playJobAction {
+			log.Debugfln("Handling run job request for check run %d (%s) in %s", evt.GetCheckRun().GetID(), evt.GetCheckRun().GetName(), rec.Repository)
+			handler = playManualJob
+		} else {
+			break
+		}
+		if err, code := tryCIRepositories(rec.Repository, evt.GetInstallation().GetID(), func(repo *CIRepository) error {
+			return handler(repo, evt.GetCheckRun())
+		}); err != nil {
+			respondErr(w, r, err, code)
+			return
+		}
+	case *github.CheckSuiteEvent:
+		rec.Repository = evt.GetRepo().GetFullName()
+		if evt.GetAction() != "rerequested" {
+			break
+		}
+		log.Debugfln("Handling re-run request for check suite %d (%s) in %s", evt.GetCheckSuite().GetID(), evt.GetCheckSuite().GetHeadSHA(), rec.Repository)
+		if err, code := tryCIRepositories(rec.Repository, evt.GetInstallation().GetID(), func(repo *CIRepository) error {
+			return rerunCheckSuite(repo, evt.GetCheckSuite())
+		}); err != nil {
+			respondErr(w, r, err, code)
+			return
+		}
+	default:
+		log.Debugfln("Ignoring GitHub app event of type %T", evt)
+	}
+	w.WriteHeader(http.StatusOK)
+}
@@ -0,0 +1,149 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"container/list"
+	"sync"
+	"time"
+)
+
+const (
+	defaultCICacheSize = 10000
+	defaultCICacheTTL  = 24 * time.Hour
+)
+
+type cacheEntry struct {
+	key     string
+	value   int64
+	expires time.Time
+}
+
+// IDCache is a size-bounded LRU cache of IDs where entries also expire after a fixed time.
+type IDCache struct {
+	lock    sync.Mutex
+	maxSize int
+	ttl     time.Duration
+	entries map[string]*list.Element
+	order   *list.List
+
+	hits        uint64
+	misses      uint64
+	evictions   uint64
+	expirations uint64
+}
+
+type IDCacheStats struct {
+	Size        int     `json:"size"`
+	MaxSize     int     `json:"max_size"`
+	Hits        uint64  `json:"hits"`
+	Misses      uint64  `json:"misses"`
+	HitRate     float64 `json:"hit_rate"`
+	Evictions   uint64  `json:"evictions"`
+	Expirations uint64  `json:"expirations"`
+}
+
+func NewIDCache(maxSize int, ttl time.Duration) *IDCache {
+	if maxSize <= 0 {
+		maxSize = defaultCICacheSize
+	}
+	if ttl <= 0 {
+		ttl = defaultCICacheTTL
+	}
+	return &IDCache{
+		maxSize: maxSize,
+		ttl:     ttl,
+		entries: make(map[string]*list.Element),
+		order:   list.New(),
+	}
+}
+
+func (cache *IDCache) Get(key string) (int64, bool) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	elem, ok := cache.entries[key]
+	if !ok {
+		cache.misses++
+		return 0, false
+	}
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		cache.order.Remove(elem)
+		delete(cache.entries, key)
+		cache.expirations++
+		cache.misses++
+		return 0, false
+	}
+	cache.order.MoveToFront(elem)
+	cache.hits++
+	return entry.value, true
+}
+
+func (cache *IDCache) Set(key string, value int64) {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	expires := time.Now().Add(cache.ttl)
+	if elem, ok := cache.entries[key]; ok {
+		entry := elem.Value.(*cacheEntry)
+		entry.value = value
+		entry.expires = expires
+		cache.order.MoveToFront(elem)
+		return
+	}
+	cache.entries[key] = cache.order.PushFront(&cacheEntry{key: key, value: value, expires: expires})
+	for cache.order.Len() > cache.maxSize {
+		oldest := cache.order.Back()
+		cache.order.Remove(oldest)
+		delete(cache.entries, oldest.Value.(*cacheEntry).key)
+		cache.evictions++
+	}
+}
+
+// RemoveExpired drops all expired entries. Expired entries are also dropped lazily in Get,
+// but this makes sure entries that are never looked up again don't stay around until they're evicted.
+func (cache *IDCache) RemoveExpired() {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	now := time.Now()
+	for elem := cache.order.Back(); elem != nil; {
+		entry := elem.Value.(*cacheEntry)
+		prev := elem.Prev()
+		if now.After(entry.expires) {
+			cache.order.Remove(elem)
+			delete(cache.entries, entry.key)
+			cache.expirations++
+		}
+		elem = prev
+	}
+}
+
+func (cache *IDCache) Stats() IDCacheStats {
+	cache.lock.Lock()
+	defer cache.lock.Unlock()
+	stats := IDCacheStats{
+		Size:        cache.order.Len(),
+		MaxSize:     cache.maxSize,
+		Hits:        cache.hits,
+		Misses:      cache.misses,
+		Evictions:   cache.evictions,
+		Expirations: cache.expirations,
+	}
+	if total := cache.hits + cache.misses; total > 0 {
+		stats.HitRate = float64(cache.hits) / float64(total)
+	}
+	return stats
+}
@@ -26,6 +26,8 @@ import (
 	"runtime/debug"
 	"strconv"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	"github.com/bradleyfalzon/ghinstallation/v2"
 	"github.com/go-playground/webhooks/v6/gitlab"
@@ -39,12 +41,46 @@ var appTransport *ghinstallation.AppsTransport
 var installationClients = make(map[int64]*github.Client)
 var installationClientsLock sync.Mutex
 
+var checkSuiteCache = NewIDCache(defaultCICacheSize, defaultCICacheTTL)
+var checkRunCache = NewIDCache(defaultCICacheSize, defaultCICacheTTL)
+var prCommentCache = NewIDCache(defaultCICacheSize, defaultCICacheTTL)
+var ciMappingStoreHits, externalIDLookups, externalIDLookupHits uint64
+
+type CICacheMetrics struct {
+	CheckSuites IDCacheStats `json:"check_suites"`
+	CheckRuns   IDCacheStats `json:"check_runs"`
+	PRComments  IDCacheStats `json:"pr_comments"`
+	// Number of cache misses that were found in the database.
+	StoreHits uint64 `json:"store_hits"`
+	// Number of check run IDs that had to be looked up through the Checks API, and how many of those were found.
+	ExternalIDLookups    uint64 `json:"external_id_lookups"`
+	ExternalIDLookupHits uint64 `json:"external_id_lookup_hits"`
+}
+
+func initCICaches() {
+	ttl := time.Duration(config.CICache.TTL) * time.Second
+	checkSuiteCache = NewIDCache(config.CICache.Size, ttl)
+	checkRunCache = NewIDCache(config.CICache.Size, ttl)
+	prCommentCache = NewIDCache(config.CICache.Size, ttl)
+}
+
+func getCICacheMetrics() *CICacheMetrics {
+	return &CICacheMetrics{
+		CheckSuites:          checkSuiteCache.Stats(),
+		CheckRuns:            checkRunCache.Stats(),
+		PRComments:           prCommentCache.Stats(),
+		StoreHits:            atomic.LoadUint64(&ciMappingStoreHits),
+		ExternalIDLookups:    atomic.LoadUint64(&externalIDLookups),
+		ExternalIDLookupHits: atomic.LoadUint64(&externalIDLookupHits),
+	}
+}
+
 func installationGHClient(installationID int64) *github.Client {
 	installationClientsLock.Lock()
 	cli, ok := installationClients[installationID]
 	if !ok {
 		cli = github.NewClient(&http.Client{
-			Transport: ghinstallation.NewFromAppsTransport(appTransport, installationID),
+			Transport: newRetryTransport(ghinstallation.NewFromAppsTransport(appTransport, installationID)),
 		})
 		installationClients[installationID] = cli
 	}
@@ -54,15 +90,14 @@ func installationGHClient(installationID int64) *github.Client {
 
 func initGHClient() {
 	var err error
-	appTransport, err = ghinstallation.NewAppsTransport(http.DefaultTransport, config.GitHubApp.ID, []byte(config.GitHubApp.PrivateKey))
+	appTransport, err = ghinstallation.NewAppsTransport(http.DefaultTransport, config.GitHubApp.ID, []byte(config.GitHubApp.PrivateKey.Value))
 	if err != nil {
 		panic(err)
 	}
-	appGHClient = github.NewClient(&http.Client{Transport: appTransport})
+	appGHClient = github.NewClient(&http.Client{Transport: newRetryTransport(appTransport)})
 
-	installationIDChanged := false
-	for _, repo := range config.CIRepositories {
-		if repo.InstallationID != 0 {
+	for projectID, repo := range getCIRepositories() {
+		if repo.InstallationID != 0 || repo.usesCommitStatuses() {
 			continue
 		}
 		installation, _, err := appGHClient.Apps.FindRepositoryInstallation(context.Background(), repo.Owner, repo.Name)
@@ -73,39 +108,38 @@ func initGHClient() {
 			log.Infofln("Found installation ID for %s/%s: %d", repo.Owner, repo.Name, installation.GetID())
 			repo.InstallationID = installation.GetID()
 		}
-		installationIDChanged = true
-	}
-	if installationIDChanged {
-		saveConfig()
+		if err = putCIRepository(projectID, repo); err != nil {
+			log.Errorfln("Failed to save installation ID for %s/%s: %v", repo.Owner, repo.Name, err)
+		}
 	}
 }
 
 func ensureCheckSuiteExists(repo *CIRepository, ref, sha string) {
-	repo.mapLock.RLock()
-	_, ok := repo.checkSuiteIDs[sha]
-	repo.mapLock.RUnlock()
-	if ok {
+	if repo.usesCommitStatuses() {
+		return
+	} else if _, ok := repo.getCheckSuiteID(sha); ok {
 		return
 	}
 	cli := installationGHClient(repo.InstallationID)
-	suite, resp, err := cli.Checks.CreateCheckSuite(context.Background(), repo.Owner, repo.Name, github.CreateCheckSuiteOptions{
-		HeadSHA:    sha,
-		HeadBranch: &ref,
+	var suite *github.CheckSuite
+	var resp *github.Response
+	err := retryOnRateLimit("create check suite", func() (err error) {
+		suite, resp, err = cli.Checks.CreateCheckSuite(context.Background(), repo.Owner, repo.Name, github.CreateCheckSuiteOptions{
+			HeadSHA:    sha,
+			HeadBranch: &ref,
+		})
+		return
 	})
 	if err != nil {
-		if resp.StatusCode == 422 {
+		if resp != nil && resp.StatusCode == 422 {
 			log.Debugfln("Got 422 while creating check suite for %s/%s in %s/%s", ref, sha, repo.Owner, repo.Name)
-			repo.mapLock.Lock()
-			repo.checkSuiteIDs[sha] = -1
-			repo.mapLock.Unlock()
+			repo.setCheckSuiteID(sha, -1)
 		} else {
 			log.Errorfln("Failed to create check suite for %s/%s in %s/%s: %v", ref, sha, repo.Owner, repo.Name, err)
 		}
 	} else {
 		log.Debugfln("Created check suite for %s/%s in %s/%s: %d", ref, sha, repo.Owner, repo.Name, *suite.ID)
-		repo.mapLock.Lock()
-		repo.checkSuiteIDs[sha] = suite.GetID()
-		repo.mapLock.Unlock()
+		repo.setCheckSuiteID(sha, suite.GetID())
 	}
 }
 
@@ -113,6 +147,10 @@ func handlePipelineEvent(repo *CIRepository, evt gitlab.PipelineEventPayload) {
 	repo.plock.Lock(evt.ObjectAttributes.SHA)
 	defer repo.plock.Unlock(evt.ObjectAttributes.SHA)
 	ensureCheckSuiteExists(repo, evt.ObjectAttributes.Ref, evt.ObjectAttributes.SHA)
+	updatePipelineCheckRun(repo, &evt)
+	if repo.PRComment {
+		schedulePRCommentUpdate(repo, evt.ObjectAttributes.ID, &evt)
+	}
 }
 
 var (
@@ -143,7 +181,57 @@ func stringPtr(str string) *string {
 	return &str
 }
 
-func handleJobEvent(repo *CIRepository, evt gitlab.JobEventPayload) {
+// findCheckRunByExternalID finds the newest check run for the given job through the Checks API.
+// This is used when the check run ID has been evicted from the cache and database.
+func findCheckRunByExternalID(cli *github.Client, repo *CIRepository, sha, name, externalID string) (int64, bool) {
+	atomic.AddUint64(&externalIDLookups, 1)
+	runs, _, err := cli.Checks.ListCheckRunsForRef(context.Background(), repo.Owner, repo.Name, sha, &github.ListCheckRunsOptions{
+		CheckName:   &name,
+		Filter:      stringPtr("all"),
+		ListOptions: github.ListOptions{PerPage: 100},
+	})
+	if err != nil {
+		log.Warnfln("Failed to list check runs of %s in %s/%s: %v", sha, repo.Owner, repo.Name, err)
+		return 0, false
+	}
+	var runID int64
+	for _, run := range runs.CheckRuns {
+		if run.GetExternalID() == externalID && run.GetID() > runID {
+			runID = run.GetID()
+		}
+	}
+	if runID == 0 {
+		return 0, false
+	}
+	atomic.AddUint64(&externalIDLookupHits, 1)
+	return runID, true
+}
+
+// canPlayManualJobs checks whether manual jobs can be started from GitHub, which requires both the app webhook
+// for receiving the requested action and the GitLab API for starting the job.
+func (repo *CIRepository) canPlayManualJobs() bool {
+	if len(config.Server.AppWebhookEndpoint) == 0 || len(config.GitHubApp.WebhookSecret.Value) == 0 {
+		return false
+	}
+	_, err := repo.gitlabClient()
+	return err == nil
+}
+
+func handleJobEvent(repo *CIRepository, evt JobEvent) {
+	if repo.PRComment {
+		// Pipeline events are only sent when the status of the whole pipeline changes
+		schedulePRCommentUpdate(repo, evt.PipelineID, nil)
+	}
+	syncJobCheckRun(repo, evt, false)
+}
+
+// syncJobCheckRun creates or updates the check run of a job. If newRun is true, a new check run will be created
+// even if the job already has one, e.g. when a manual job that was marked as completed is started.
+func syncJobCheckRun(repo *CIRepository, evt JobEvent, newRun bool) {
+	if !repo.Jobs.shouldMirror(evt.BuildName, evt.BuildStage) {
+		log.Debugfln("Ignoring build event in %d for build %d (%s) as it's excluded by the job rules", evt.ProjectID, evt.BuildID, evt.BuildName)
+		return
+	}
 	repo.plock.Lock(evt.SHA)
 	defer repo.plock.Unlock(evt.SHA)
 	log.Debugfln("Received build event in %d (%s) for build %d (%s). Current status is %s/%s",
@@ -153,7 +241,7 @@ func handleJobEvent(repo *CIRepository, evt gitlab.JobEventPayload) {
 	detailsURL := fmt.Sprintf("%s/-/jobs/%d", evt.Repository.Homepage, evt.BuildID)
 	externalID := strconv.FormatInt(evt.BuildID, 10)
 	opts := github.CreateCheckRunOptions{
-		Name:       evt.BuildName,
+		Name:       repo.Jobs.checkRunName(evt.BuildName, evt.BuildStage),
 		HeadSHA:    evt.SHA,
 		DetailsURL: &detailsURL,
 		ExternalID: &externalID,
@@ -163,9 +251,33 @@ func handleJobEvent(repo *CIRepository, evt gitlab.JobEventPayload) {
 	case "created":
 		opts.Output.Title = stringPtr("Job created")
 		opts.Output.Summary = stringPtr("This job has not been triggered yet. It depends on upstream jobs that need to succeed in order for this job to be triggered.")
+	case "waiting_for_resource":
+		opts.Output.Title = stringPtr("Job waiting for resource")
+		opts.Output.Summary = stringPtr("This job is waiting for a resource (e.g. a deployment environment) to become available.")
+	case "preparing":
+		opts.Output.Title = stringPtr("Job preparing")
+		opts.Output.Summary = stringPtr("A runner has picked up this job and is preparing the execution environment.")
 	case "pending":
 		opts.Output.Title = stringPtr("Job pending")
 		opts.Output.Summary = stringPtr("This job is waiting for a runner to pick it up.")
+	case "scheduled":
+		opts.Output.Title = stringPtr("Job scheduled")
+		opts.Output.Summary = stringPtr("This is a delayed job that will start automatically after its timer runs out.")
+	case "manual":
+		opts.Status = &statusCompleted
+		opts.Conclusion = &conclusionActionRequired
+		opts.CompletedAt = &github.Timestamp{Time: time.Now()}
+		opts.Output.Title = stringPtr("Job waiting for manual action")
+		if repo.canPlayManualJobs() {
+			opts.Output.Summary = stringPtr("This job must be started manually. Use the Run job button or start it in GitLab.")
+			opts.Actions = []*github.CheckRunAction{{
+				Label:       "Run job",
+				Description: "Start this manual job in GitLab",
+				Identifier:  playJobAction,
+			}}
+		} else {
+			opts.Output.Summary = stringPtr("This job must be started manually in GitLab.")
+		}
 	case "running":
 		opts.Status = &statusInProgress
 		opts.StartedAt = &github.Timestamp{Time: evt.BuildStartedAt.Time}
@@ -185,6 +297,12 @@ func handleJobEvent(repo *CIRepository, evt gitlab.JobEventPayload) {
 		opts.CompletedAt = &github.Timestamp{Time: evt.BuildFinishedAt.Time}
 		opts.Output.Title = stringPtr("Job canceled")
 		opts.Output.Summary = stringPtr("This job was canceled.")
+	case "skipped":
+		opts.Status = &statusCompleted
+		opts.Conclusion = &conclusionSkipped
+		opts.CompletedAt = &github.Timestamp{Time: time.Now()}
+		opts.Output.Title = stringPtr("Job skipped")
+		opts.Output.Summary = stringPtr("This job was not run, e.g. because a job in an earlier stage failed.")
 	case "failed":
 		opts.Status = &statusCompleted
 		opts.Conclusion = &conclusionFailure
@@ -200,41 +318,87 @@ func handleJobEvent(repo *CIRepository, evt gitlab.JobEventPayload) {
 		}
 		opts.StartedAt = &github.Timestamp{Time: evt.BuildStartedAt.Time}
 		opts.CompletedAt = &github.Timestamp{Time: evt.BuildFinishedAt.Time}
+		if repo.LogExcerptLines > 0 && !repo.usesCommitStatuses() {
+			if excerpt, err := getJobLogExcerpt(repo, &evt.JobEventPayload); err != nil {
+				log.Warnfln("Failed to get log excerpt of job %d in %d: %v", evt.BuildID, evt.ProjectID, err)
+			} else if len(excerpt) > 0 {
+				opts.Output.Text = &excerpt
+			}
+		}
 	default:
 		log.Warnfln("Unknown build status %s", evt.BuildStatus)
 		return
 	}
+	applyOutputTemplates(repo, &evt, &opts)
 
-	repo.mapLock.RLock()
-	runID, ok := repo.checkRunIDs[evt.BuildID]
-	repo.mapLock.RUnlock()
-
-	var run *github.CheckRun
-	var err error
-	var action string
-
+	if repo.usesCommitStatuses() {
+		if evt.BuildStatus == "manual" && evt.BuildAllowFailure {
+			// Commit statuses have no state for optional manual jobs, and pending would keep the combined
+			// status of the commit pending until someone starts the job. The title still says it's waiting.
+			opts.Conclusion = &conclusionSkipped
+		}
+		postCommitStatus(repo, &opts)
+		return
+	}
 	cli := installationGHClient(repo.InstallationID)
+	// Newly created jobs won't have a check run yet, and running jobs always get a new check run,
+	// so there's no point in looking for an existing one in those cases.
 	// For running we have to create a new check run, because the go-github library doesn't expose StartedAt in the update fields
-	if !ok || evt.BuildStatus == "running" {
+	lookup := evt.BuildStatus != "created" && evt.BuildStatus != "running"
+	queueCheckRunUpdate(&checkRunUpdate{
+		cli:         cli,
+		repo:        repo,
+		opts:        opts,
+		forceCreate: newRun || evt.BuildStatus == "running",
+		lookup:      lookup,
+		callback: func(run *github.CheckRun, action string, err error) {
+			if err != nil {
+				log.Errorfln("Failed to %s check run for %s/%s/%s in %s/%s: %v", action, evt.Ref, evt.SHA, evt.BuildName, repo.Owner, repo.Name, err)
+				return
+			}
+			log.Infofln("Successfully %sd check run for %s/%s/%s#%d in %s/%s. Run ID: %d, status: %s %s", action, evt.Ref, evt.SHA, evt.BuildName, evt.BuildID, repo.Owner, repo.Name, run.GetID(), run.GetStatus(), run.GetConclusion())
+			if repo.TestReportAnnotations && (evt.BuildStatus == "success" || evt.BuildStatus == "failed") {
+				addTestFailureAnnotations(cli, repo, &evt.JobEventPayload, run.GetID(), opts)
+			}
+		},
+	})
+}
+
+// createOrUpdateCheckRun creates a check run, or updates the existing check run with the same external ID.
+// If forceCreate is true, a new check run is always created. If lookup is true, check runs that aren't
+// cached or stored in the database are looked up through the Checks API.
+func createOrUpdateCheckRun(cli *github.Client, repo *CIRepository, opts github.CreateCheckRunOptions, forceCreate, lookup bool) (run *github.CheckRun, action string, err error) {
+	externalID := opts.GetExternalID()
+	runID, ok := repo.getCheckRunID(externalID)
+	if !ok && !forceCreate && lookup {
+		if runID, ok = findCheckRunByExternalID(cli, repo, opts.HeadSHA, opts.Name, externalID); ok {
+			repo.setCheckRunID(externalID, runID)
+		}
+	}
+	if !ok || forceCreate {
 		run, _, err = cli.Checks.CreateCheckRun(context.Background(), repo.Owner, repo.Name, opts)
 		action = "create"
 	} else {
 		run, _, err = cli.Checks.UpdateCheckRun(context.Background(), repo.Owner, repo.Name, runID, makeUpdateFromCreate(opts))
 		action = "update"
 	}
-	if err != nil {
-		log.Errorfln("Failed to %s check run for %s/%s/%s in %s/%s: %v", action, evt.Ref, evt.SHA, evt.BuildName, repo.Owner, repo.Name, err)
-	} else {
-		log.Infofln("Successfully %sd check run for %s/%s/%s#%d in %s/%s. Run ID: %d, status: %s %s", action, evt.Ref, evt.SHA, evt.BuildName, evt.BuildID, repo.Owner, repo.Name, run.GetID(), run.GetStatus(), run.GetConclusion())
-		if run.ID != nil && *run.ID != runID {
-			repo.mapLock.Lock()
-			repo.checkRunIDs[evt.BuildID] = *run.ID
-			repo.mapLock.Unlock()
-		}
+	if err == nil && run.GetID() != runID {
+		repo.setCheckRunID(externalID, run.GetID())
 	}
+	return
+}
+
+// ciEventKey returns the background event queue key for a commit, so that the events of each commit are mirrored in order.
+func ciEventKey(projectID int64, sha string) string {
+	return fmt.Sprintf("%d/%s", projectID, sha)
 }
 
+// handleCIWebhook checks and parses GitLab webhooks and queues the events to be mirrored in the background,
+// as the GitHub API calls can take longer than GitLab is willing to wait for a response.
 func handleCIWebhook(w http.ResponseWriter, r *http.Request) {
+	rec := newDeliveryRecorder(w, "gitlab", r.Header.Get("X-Gitlab-Event-UUID"), r.Header.Get("X-Gitlab-Event"))
+	w = rec
+	defer rec.save()
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -251,15 +415,36 @@ func handleCIWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body = io.NopCloser(bytes.NewReader(body))
 
+	if gitlab.Event(r.Header.Get("X-Gitlab-Event")) == deploymentEvents {
+		var evt GLDeploymentEvent
+		if err = json.Unmarshal(body, &evt); err != nil {
+			respondErr(w, r, err, http.StatusBadRequest)
+			return
+		}
+		rec.Repository = strconv.FormatInt(evt.Project.ID, 10)
+		if repo, err, code := checkGLToken(r, evt.Project.ID); err != nil {
+			respondErr(w, r, err, code)
+		} else if !repo.Deployments {
+			log.Debugfln("Ignoring deployment event from %d as deployments aren't enabled", evt.Project.ID)
+			w.WriteHeader(http.StatusOK)
+		} else {
+			log.Debugfln("Queueing deployment event from %d", evt.Project.ID)
+			queueEvent(ciEventKey(evt.Project.ID, evt.SHA()), func() { handleDeploymentEvent(repo, &evt) })
+			w.WriteHeader(http.StatusAccepted)
+		}
+		return
+	}
+
 	rawEvt, err := glHook.Parse(r, gitlab.BuildEvents, gitlab.JobEvents, gitlab.PipelineEvents)
 	if err != nil {
 		respondErr(w, r, err, http.StatusBadRequest)
 		return
 	}
 
-	// The webhook library is a bit of a mess, so fix it here
-	if _, ok := rawEvt.(gitlab.BuildEventPayload); ok {
-		var fixedPayload gitlab.JobEventPayload
+	// The webhook library is a bit of a mess and doesn't parse all fields, so parse job events manually
+	switch rawEvt.(type) {
+	case gitlab.BuildEventPayload, gitlab.JobEventPayload:
+		var fixedPayload JobEvent
 		err = json.Unmarshal(body, &fixedPayload)
 		if err != nil {
 			respondErr(w, r, err, http.StatusBadRequest)
@@ -269,21 +454,23 @@ func handleCIWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 
 	switch evt := rawEvt.(type) {
-	case gitlab.JobEventPayload:
+	case JobEvent:
+		rec.Repository = strconv.FormatInt(evt.ProjectID, 10)
 		if repo, err, code := checkGLToken(r, evt.ProjectID); err != nil {
 			respondErr(w, r, err, code)
 		} else {
-			log.Debugfln("Handling job event from %d", evt.ProjectID)
-			handleJobEvent(repo, evt)
-			w.WriteHeader(http.StatusOK)
+			log.Debugfln("Queueing job event from %d", evt.ProjectID)
+			queueEvent(ciEventKey(evt.ProjectID, evt.SHA), func() { handleJobEvent(repo, evt) })
+			w.WriteHeader(http.StatusAccepted)
 		}
 	case gitlab.PipelineEventPayload:
+		rec.Repository = strconv.FormatInt(evt.Project.ID, 10)
 		if repo, err, code := checkGLToken(r, evt.Project.ID); err != nil {
 			respondErr(w, r, err, code)
 		} else {
-			log.Debugfln("Handling pipeline event from %d", evt.Project.ID)
-			handlePipelineEvent(repo, evt)
-			w.WriteHeader(http.StatusOK)
+			log.Debugfln("Queueing pipeline event from %d", evt.Project.ID)
+			queueEvent(ciEventKey(evt.Project.ID, evt.ObjectAttributes.SHA), func() { handlePipelineEvent(repo, evt) })
+			w.WriteHeader(http.StatusAccepted)
 		}
 	default:
 		log.Errorfln("Unexpected event type %T", evt)
@@ -0,0 +1,194 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/subtle"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// CIStatusRequest is the body of requests to the generic CI status endpoint.
+type CIStatusRequest struct {
+	// The commit the status is for.
+	SHA string `json:"sha"`
+	// The branch or tag name.
+	Ref string `json:"ref"`
+	// The name of the job, used as the check run name.
+	Name string `json:"name"`
+	// The job status: pending, running, success, failure, error, canceled or skipped.
+	Status string `json:"status"`
+	// Link to the job in the CI system.
+	URL string `json:"url"`
+	// Optional markdown summary. Defaults to a description of the status.
+	Summary string `json:"summary"`
+}
+
+// ciStatusExternalID returns the external ID for check runs created through the generic CI status endpoint.
+// Job names aren't unique across commits, so the commit is included in the ID.
+func ciStatusExternalID(sha, name string) string {
+	return fmt.Sprintf("status:%s:%s", sha, name)
+}
+
+// makeCIStatusCheckRun converts a generic CI status into check run options like handleJobEvent does for GitLab jobs.
+func makeCIStatusCheckRun(req *CIStatusRequest) (github.CreateCheckRunOptions, error) {
+	externalID := ciStatusExternalID(req.SHA, req.Name)
+	opts := github.CreateCheckRunOptions{
+		Name:       req.Name,
+		HeadSHA:    req.SHA,
+		ExternalID: &externalID,
+		Output:     &github.CheckRunOutput{},
+	}
+	if len(req.URL) > 0 {
+		opts.DetailsURL = &req.URL
+	}
+	var summary string
+	switch strings.ToLower(req.Status) {
+	case "pending":
+		opts.Output.Title = stringPtr("Job pending")
+		summary = "This job is waiting to be run."
+	case "running":
+		opts.Status = &statusInProgress
+		opts.StartedAt = &github.Timestamp{Time: time.Now()}
+		opts.Output.Title = stringPtr("Job running")
+		summary = "This job is running."
+	case "success":
+		opts.Conclusion = &conclusionSuccess
+		opts.Output.Title = stringPtr("Job successful")
+		summary = "This job completed successfully."
+	case "failure", "failed":
+		opts.Conclusion = &conclusionFailure
+		opts.Output.Title = stringPtr("Job failed")
+		summary = "This job failed."
+	case "error":
+		opts.Conclusion = &conclusionFailure
+		opts.Output.Title = stringPtr("Job errored")
+		summary = "This job couldn't be run because of an error."
+	case "canceled", "cancelled":
+		opts.Conclusion = &conclusionCancelled
+		opts.Output.Title = stringPtr("Job canceled")
+		summary = "This job was canceled."
+	case "skipped":
+		opts.Conclusion = &conclusionSkipped
+		opts.Output.Title = stringPtr("Job skipped")
+		summary = "This job was skipped."
+	default:
+		return opts, fmt.Errorf("unknown status %q", req.Status)
+	}
+	if opts.Conclusion != nil {
+		opts.Status = &statusCompleted
+		opts.CompletedAt = &github.Timestamp{Time: time.Now()}
+	}
+	if len(req.Summary) > 0 {
+		summary = req.Summary
+	}
+	opts.Output.Summary = &summary
+	return opts, nil
+}
+
+// handleCIStatus sends a generic CI status to GitHub like syncJobCheckRun does for GitLab jobs.
+func handleCIStatus(repo *CIRepository, req *CIStatusRequest, opts github.CreateCheckRunOptions) {
+	repo.plock.Lock(req.SHA)
+	defer repo.plock.Unlock(req.SHA)
+	ensureCheckSuiteExists(repo, req.Ref, req.SHA)
+	if repo.usesCommitStatuses() {
+		postCommitStatus(repo, &opts)
+		return
+	}
+	queueCheckRunUpdate(&checkRunUpdate{
+		cli:    installationGHClient(repo.InstallationID),
+		repo:   repo,
+		opts:   opts,
+		lookup: true,
+		callback: func(run *github.CheckRun, action string, err error) {
+			if err != nil {
+				log.Errorfln("Failed to %s check run for %s/%s/%s in %s/%s: %v", action, req.Ref, req.SHA, req.Name, repo.Owner, repo.Name, err)
+				return
+			}
+			log.Infofln("Successfully %sd check run for %s/%s/%s in %s/%s. Run ID: %d, status: %s %s", action, req.Ref, req.SHA, req.Name, repo.Owner, repo.Name, run.GetID(), run.GetStatus(), run.GetConclusion())
+		},
+	})
+}
+
+// checkCIStatusToken finds the CI repository and checks the bearer token of a generic CI status request.
+func checkCIStatusToken(r *http.Request) (repo *CIRepository, err error, code int) {
+	projectID, err := strconv.ParseInt(r.URL.Query().Get("project_id"), 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("invalid project ID: %w", err), http.StatusBadRequest
+	}
+	repo, ok := getCIRepository(projectID)
+	if !ok {
+		return nil, errors.New("unknown repository"), http.StatusNotFound
+	}
+	token := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if len(repo.StatusToken.Value) == 0 || subtle.ConstantTimeCompare([]byte(token), []byte(repo.StatusToken.Value)) != 1 {
+		return nil, errors.New("invalid status token"), http.StatusUnauthorized
+	} else if !repo.usesCommitStatuses() && appTransport == nil {
+		return nil, errors.New("repository uses the checks mode, but the GitHub app is not configured"), http.StatusServiceUnavailable
+	}
+	return repo, nil, http.StatusOK
+}
+
+func handleCIStatusRequest(w http.ResponseWriter, r *http.Request) {
+	rec := newDeliveryRecorder(w, "ci-status", "", "status")
+	w = rec
+	defer rec.save()
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Errorln("Handling CI status request from", readUserIP(r), "panicked:", err)
+			debug.PrintStack()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	if r.Method != http.MethodPost {
+		w.WriteHeader(http.StatusMethodNotAllowed)
+		return
+	}
+	rec.Repository = r.URL.Query().Get("project_id")
+	repo, err, code := checkCIStatusToken(r)
+	if err != nil {
+		respondErr(w, r, err, code)
+		return
+	}
+	var req CIStatusRequest
+	if err = json.NewDecoder(r.Body).Decode(&req); err != nil {
+		respondErr(w, r, fmt.Errorf("failed to parse request body: %w", err), http.StatusBadRequest)
+		return
+	} else if len(req.SHA) == 0 || len(req.Name) == 0 || len(req.Status) == 0 {
+		respondErr(w, r, errors.New("sha, name and status are required"), http.StatusBadRequest)
+		return
+	}
+	opts, err := makeCIStatusCheckRun(&req)
+	if err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	}
+	// The status is sent in the background, so that the request doesn't wait for GitHub rate limits
+	queueEvent(ciEventKey(repo.projectID, req.SHA), func() { handleCIStatus(repo, &req, opts) })
+	w.WriteHeader(http.StatusAccepted)
+}
@@ -0,0 +1,390 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+	"maunium.net/go/mauflag"
+	log "maunium.net/go/maulogger/v2"
+)
+
+func makeManagementFlag(long, valueName, usage string) *mauflag.Flag {
+	return mauflag.Make().LongKey(long).ValueName(valueName).Usage(usage).UsageCategory("Management")
+}
+
+var adminURL = makeManagementFlag("url", "url", "Base URL of a running instance's admin API. If set, management commands use the API instead of the database").String()
+var adminSecretFlag = makeManagementFlag("admin-secret", "secret", "Admin API secret. Defaults to the MAUMIRROR_ADMIN_SECRET environment variable").String()
+var targetFlag = makeManagementFlag("target", "url", "Target repo URL for repo add").String()
+var sourceFlag = makeManagementFlag("source", "url", "Source repo URL override for repo add").String()
+var pushKeyFlag = makeManagementFlag("push-key", "path", "Path to SSH key for pushing for repo add").String()
+var pullKeyFlag = makeManagementFlag("pull-key", "path", "Path to SSH key for pulling for repo add").String()
+var secretFlag = makeManagementFlag("secret", "secret", "Webhook secret for repo add and ci add. Generated if not set").String()
+var githubTokenFlag = makeManagementFlag("github-token", "token", "GitHub access token for creating the webhook in repo add, or for setting commit statuses in ci add --mode statuses").String()
+var lfsFlag = makeManagementFlag("lfs", "", "Enable LFS mirroring for repo add").Bool()
+var mirrorWikiFlag = makeManagementFlag("mirror-wiki", "", "Enable wiki mirroring for repo add").Bool()
+var ciModeFlag = makeManagementFlag("mode", "mode", "CI status mode for ci add: checks (default, uses the GitHub app), statuses (uses --github-token) or gitea (uses --gitea-url and --gitea-token)").String()
+var giteaURLFlag = makeManagementFlag("gitea-url", "url", "Gitea or Forgejo instance URL for ci add --mode gitea").String()
+var giteaTokenFlag = makeManagementFlag("gitea-token", "token", "Gitea or Forgejo access token for ci add --mode gitea").String()
+var installationIDFlag = makeManagementFlag("installation-id", "id", "GitHub app installation ID for ci add. Found automatically if not set").Int64()
+var gitlabURLFlag = makeManagementFlag("gitlab-url", "url", "GitLab instance URL for ci add, used for calling the GitLab API").String()
+var gitlabTokenFlag = makeManagementFlag("gitlab-token", "token", "GitLab access token for ci add, used for calling the GitLab API").String()
+
+const cliUsage = `Management commands:
+  repo list                  List mirrored repositories.
+  repo show <owner/name>     Show the configuration of a repository.
+  repo add <owner/name>      Add a repository. Requires --target.
+  repo remove <owner/name>   Remove a repository.
+  sync <owner/name>          Mirror a repository in the foreground.
+  ci add <project ID> <owner/name>
+                             Add a GitLab project for mirroring CI status to a GitHub repo.
+
+Commands operate on the database, or a running instance if --url is set.
+Flag values must be passed as a separate argument (--target <url>), not with =.`
+
+var errInvalidUsage = errors.New("invalid usage")
+
+func cliCommand(args []string) int {
+	err := runCLICommand(args)
+	if errors.Is(err, errInvalidUsage) {
+		_, _ = fmt.Fprintln(os.Stderr, cliUsage)
+		return 1
+	} else if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Error:", err)
+		return 1
+	}
+	return 0
+}
+
+func runCLICommand(args []string) error {
+	command := args[0]
+	if command != "sync" && len(args) > 1 {
+		command += " " + args[1]
+	}
+	var cli cliBackend
+	if len(*adminURL) > 0 {
+		secret := *adminSecretFlag
+		if len(secret) == 0 {
+			secret = os.Getenv("MAUMIRROR_ADMIN_SECRET")
+		}
+		cli = &remoteCLI{baseURL: strings.TrimSuffix(*adminURL, "/"), secret: secret}
+	} else if err, _ := loadConfig(); err != nil {
+		return err
+	} else if err, _ = initStore(); err != nil {
+		return err
+	} else {
+		defer store.Close()
+		cli = &localCLI{}
+	}
+
+	switch {
+	case command == "repo list" && len(args) == 2:
+		return cli.ListRepos()
+	case command == "repo show" && len(args) == 3:
+		return cli.ShowRepo(args[2])
+	case command == "repo add" && len(args) == 3:
+		if len(*targetFlag) == 0 {
+			return fmt.Errorf("%w: --target is required", errInvalidUsage)
+		}
+		return cli.AddRepo(&CreateMirrorRequest{
+			Name: args[2],
+			Repo: Repository{
+				Source:     *sourceFlag,
+				Secret:     Secret{Value: *secretFlag},
+				Target:     *targetFlag,
+				PushKey:    *pushKeyFlag,
+				PullKey:    *pullKeyFlag,
+				LFS:        *lfsFlag,
+				MirrorWiki: *mirrorWikiFlag,
+			},
+			GitHubToken: *githubTokenFlag,
+		})
+	case command == "repo remove" && len(args) == 3:
+		return cli.RemoveRepo(args[2])
+	case command == "sync" && len(args) == 2:
+		return cli.Sync(args[1])
+	case command == "ci add" && len(args) == 4:
+		projectID, err := strconv.ParseInt(args[2], 10, 64)
+		if err != nil {
+			return fmt.Errorf("%w: invalid project ID %q", errInvalidUsage, args[2])
+		}
+		parts := strings.Split(args[3], "/")
+		if len(parts) != 2 {
+			return fmt.Errorf("%w: GitHub repo must be in owner/name format", errInvalidUsage)
+		}
+		return cli.AddCIRepo(projectID, &CIRepository{
+			Secret:         Secret{Value: *secretFlag},
+			Owner:          parts[0],
+			Name:           parts[1],
+			Mode:           *ciModeFlag,
+			InstallationID: *installationIDFlag,
+			GitHubToken:    Secret{Value: *githubTokenFlag},
+			GiteaURL:       *giteaURLFlag,
+			GiteaToken:     Secret{Value: *giteaTokenFlag},
+			GitLabURL:      *gitlabURLFlag,
+			GitLabToken:    Secret{Value: *gitlabTokenFlag},
+		})
+	default:
+		return errInvalidUsage
+	}
+}
+
+type cliBackend interface {
+	ListRepos() error
+	ShowRepo(name string) error
+	AddRepo(req *CreateMirrorRequest) error
+	RemoveRepo(name string) error
+	Sync(name string) error
+	AddCIRepo(projectID int64, repo *CIRepository) error
+}
+
+func printRepoList(repos map[string]Repository) {
+	names := make([]string, 0, len(repos))
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		fmt.Printf("%s -> %s\n", name, repos[name].Target)
+	}
+}
+
+func printYAML(data interface{}) error {
+	out, err := yaml.Marshal(data)
+	if err != nil {
+		return err
+	}
+	fmt.Print(string(out))
+	return nil
+}
+
+func printMirrorResult(res *MirrorResult) error {
+	out, _ := json.MarshalIndent(res, "", "  ")
+	fmt.Println(string(out))
+	if len(res.Error) > 0 {
+		return errors.New(res.Error)
+	} else if res.Wiki != nil && len(res.Wiki.Error) > 0 {
+		return fmt.Errorf("wiki: %s", res.Wiki.Error)
+	}
+	return nil
+}
+
+type localCLI struct{}
+
+func (cli *localCLI) getRepo(name string) (*Repository, error) {
+	repo, ok := getRepository(name)
+	if !ok {
+		return nil, fmt.Errorf("unknown repository %s", name)
+	}
+	return repo, nil
+}
+
+func (cli *localCLI) ListRepos() error {
+	allRepos := getRepositories()
+	repos := make(map[string]Repository, len(allRepos))
+	for name, repo := range allRepos {
+		repos[name] = *repo
+	}
+	printRepoList(repos)
+	return nil
+}
+
+func (cli *localCLI) ShowRepo(name string) error {
+	repo, err := cli.getRepo(name)
+	if err != nil {
+		return err
+	}
+	// Secrets are masked like in the admin API, which the remote CLI uses
+	redacted := repo.redacted()
+	return printYAML(map[string]*Repository{name: &redacted})
+}
+
+func (cli *localCLI) AddRepo(req *CreateMirrorRequest) error {
+	if _, exists := getRepository(req.Name); exists {
+		return fmt.Errorf("repository %s already exists", req.Name)
+	}
+	repo := &req.Repo
+	repo.Name = req.Name
+	repo.Log = log.Sub(repo.Name)
+	if len(req.GitHubToken) > 0 {
+		events := []string{"push"}
+		if repo.MirrorWiki {
+			events = append(events, "gollum")
+		}
+		var err error
+		if repo.Secret.Value, err = CreateGitHubWebhook(req.GitHubToken, repo.Name, repo.Secret.Value, events); err != nil {
+			return err
+		}
+	}
+	if err := putRepository(repo); err != nil {
+		return err
+	}
+	fmt.Println("Added", repo.Name, "with push target", repo.Target)
+	return nil
+}
+
+func (cli *localCLI) RemoveRepo(name string) error {
+	if _, err := cli.getRepo(name); err != nil {
+		return err
+	}
+	if err := deleteRepository(name); err != nil {
+		return err
+	}
+	fmt.Println("Removed", name)
+	return nil
+}
+
+func (cli *localCLI) Sync(name string) error {
+	repo, err := cli.getRepo(name)
+	if err != nil {
+		return err
+	} else if err = initKnownHosts(); err != nil {
+		return fmt.Errorf("failed to initialize known_hosts: %w", err)
+	}
+	res := syncRepository(repo, fmt.Sprintf("git://github.com/%s.git", repo.Name))
+	recordRun(repo, "cli", res)
+	return printMirrorResult(res)
+}
+
+func (cli *localCLI) AddCIRepo(projectID int64, repo *CIRepository) error {
+	if _, exists := getCIRepository(projectID); exists {
+		return fmt.Errorf("CI repository %d already exists", projectID)
+	} else if err := repo.checkMode(); err != nil {
+		return err
+	} else if err = repo.compile(); err != nil {
+		return err
+	}
+	initCIRepository(repo)
+	if err := putCIRepository(projectID, repo); err != nil {
+		return err
+	}
+	fmt.Printf("Added CI repository %d to mirror status to %s/%s\n", projectID, repo.Owner, repo.Name)
+	fmt.Println("GitLab webhook secret token:", repo.Secret.Value)
+	return nil
+}
+
+type remoteCLI struct {
+	baseURL string
+	secret  string
+}
+
+func (cli *remoteCLI) request(method, path string, query url.Values, body, out interface{}) error {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return err
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	reqURL := fmt.Sprintf("%s/%s", cli.baseURL, path)
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, reqURL, reqBody)
+	if err != nil {
+		return err
+	}
+	if len(cli.secret) > 0 {
+		req.Header.Set("Authorization", "Bearer "+cli.secret)
+	}
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	// Mirror results are returned as JSON with an error status, so let the caller handle those
+	isJSON := strings.HasPrefix(resp.Header.Get("Content-Type"), "application/json")
+	if resp.StatusCode >= 300 && (!isJSON || out == nil) {
+		return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	} else if out != nil {
+		if err = json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return nil
+}
+
+func (cli *remoteCLI) ListRepos() error {
+	var repos map[string]Repository
+	if err := cli.request(http.MethodGet, "repos", nil, nil, &repos); err != nil {
+		return err
+	}
+	printRepoList(repos)
+	return nil
+}
+
+func (cli *remoteCLI) ShowRepo(name string) error {
+	var repo Repository
+	if err := cli.request(http.MethodGet, "repo", url.Values{"name": {name}}, nil, &repo); err != nil {
+		return err
+	}
+	return printYAML(map[string]*Repository{name: &repo})
+}
+
+func (cli *remoteCLI) AddRepo(req *CreateMirrorRequest) error {
+	if err := cli.request(http.MethodPost, "create", nil, req, nil); err != nil {
+		return err
+	}
+	fmt.Println("Added", req.Name, "with push target", req.Repo.Target)
+	return nil
+}
+
+func (cli *remoteCLI) RemoveRepo(name string) error {
+	if err := cli.request(http.MethodDelete, "repo", url.Values{"name": {name}}, nil, nil); err != nil {
+		return err
+	}
+	fmt.Println("Removed", name)
+	return nil
+}
+
+func (cli *remoteCLI) Sync(name string) error {
+	var res MirrorResult
+	if err := cli.request(http.MethodPost, "sync", url.Values{"name": {name}}, nil, &res); err != nil {
+		return err
+	}
+	return printMirrorResult(&res)
+}
+
+func (cli *remoteCLI) AddCIRepo(projectID int64, repo *CIRepository) error {
+	var created CIRepository
+	query := url.Values{"project_id": {strconv.FormatInt(projectID, 10)}}
+	if err := cli.request(http.MethodPost, "ci/create", query, repo, &created); err != nil {
+		return err
+	}
+	fmt.Printf("Added CI repository %d to mirror status to %s/%s\n", projectID, created.Owner, created.Name)
+	fmt.Println("GitLab webhook secret token:", created.Secret.Value)
+	return nil
+}
@@ -0,0 +1,148 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const (
+	// CIModeChecks reports CI status with check runs through the GitHub app.
+	CIModeChecks = "checks"
+	// CIModeStatuses reports CI status with commit statuses using an access token.
+	CIModeStatuses = "statuses"
+	// CIModeGitea reports CI status with commit statuses in a Gitea or Forgejo repository.
+	CIModeGitea = "gitea"
+)
+
+// The commit status API limits descriptions to 140 characters.
+const maxStatusDescriptionLength = 140
+
+func (repo *CIRepository) usesCommitStatuses() bool {
+	return repo.Mode == CIModeStatuses || repo.Mode == CIModeGitea
+}
+
+// checkMode checks that the mode of a new CI repository is known and has the credentials it needs.
+func (repo *CIRepository) checkMode() error {
+	switch repo.Mode {
+	case "", CIModeChecks:
+		return nil
+	case CIModeStatuses:
+		if len(repo.GitHubToken.Value) == 0 {
+			return errors.New("a GitHub token is required in the statuses mode")
+		}
+		return nil
+	case CIModeGitea:
+		if len(repo.GiteaURL) == 0 || len(repo.GiteaToken.Value) == 0 {
+			return errors.New("a Gitea URL and token are required in the gitea mode")
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown mode %q", repo.Mode)
+	}
+}
+
+type tokenTransport struct {
+	Token string
+	Base  http.RoundTripper
+}
+
+func (tt *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "token "+tt.Token)
+	return tt.Base.RoundTrip(req)
+}
+
+var tokenClients = make(map[string]*github.Client)
+var tokenClientsLock sync.Mutex
+
+// tokenGHClient returns a GitHub client that authenticates with an access token. Clients are reused,
+// so that requests made with the same token share the rate limit state.
+func tokenGHClient(token string) *github.Client {
+	tokenClientsLock.Lock()
+	defer tokenClientsLock.Unlock()
+	cli, ok := tokenClients[token]
+	if !ok {
+		cli = github.NewClient(&http.Client{
+			Transport: newRetryTransport(&tokenTransport{Token: token, Base: http.DefaultTransport}),
+		})
+		tokenClients[token] = cli
+	}
+	return cli
+}
+
+// commitStatusState maps a check run status and conclusion to a commit status state.
+func commitStatusState(opts *github.CreateCheckRunOptions) string {
+	if opts.Conclusion == nil {
+		return "pending"
+	}
+	switch *opts.Conclusion {
+	case conclusionSuccess, conclusionNeutral, conclusionSkipped:
+		return "success"
+	case conclusionFailure, conclusionTimedOut:
+		return "failure"
+	case conclusionActionRequired:
+		return "pending"
+	default:
+		return "error"
+	}
+}
+
+// makeCommitStatus converts check run options into a commit status, so that all modes can share the event handling.
+// The check run name is used as the status context and the output title as the description.
+func makeCommitStatus(opts *github.CreateCheckRunOptions) *github.RepoStatus {
+	description := truncateText(opts.GetOutput().GetTitle(), maxStatusDescriptionLength)
+	return &github.RepoStatus{
+		State:       stringPtr(commitStatusState(opts)),
+		TargetURL:   opts.DetailsURL,
+		Description: &description,
+		Context:     &opts.Name,
+	}
+}
+
+// postCommitStatus sends the check run as a commit status in repositories that use the statuses or gitea mode.
+func postCommitStatus(repo *CIRepository, opts *github.CreateCheckRunOptions) {
+	status := makeCommitStatus(opts)
+	var err error
+	if repo.Mode == CIModeGitea {
+		status.State = stringPtr(giteaStatusState(opts))
+		err = postGiteaStatus(repo, opts.HeadSHA, &GiteaStatus{
+			State:       status.GetState(),
+			TargetURL:   status.GetTargetURL(),
+			Description: status.GetDescription(),
+			Context:     status.GetContext(),
+		})
+	} else {
+		cli := tokenGHClient(repo.GitHubToken.Value)
+		err = retryOnRateLimit("set commit status", func() error {
+			_, _, err := cli.Repositories.CreateStatus(context.Background(), repo.Owner, repo.Name, opts.HeadSHA, status)
+			return err
+		})
+	}
+	if err != nil {
+		log.Errorfln("Failed to set %s commit status of %s in %s/%s: %v", opts.Name, opts.HeadSHA, repo.Owner, repo.Name, err)
+	} else {
+		log.Infofln("Successfully set %s commit status of %s in %s/%s to %s", opts.Name, opts.HeadSHA, repo.Owner, repo.Name, status.GetState())
+	}
+}
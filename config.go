@@ -18,7 +18,8 @@ package main
 
 import (
 	"os"
-	"sync"
+	"regexp"
+	"text/template"
 
 	"maunium.net/go/maulogger/v2"
 )
@@ -26,13 +27,15 @@ import (
 type Config struct {
 	// Cloned repo storage directory.
 	DataDir string `yaml:"datadir"`
+	// Path to the database for repositories, CI state and history. Defaults to <datadir>/maumirror.db.
+	Database string `yaml:"database,omitempty"`
 
 	// HTTP server configuration.
 	Server struct {
 		// Endpoint for admin API (e.g. dynamically adding webhooks).
 		AdminEndpoint string `yaml:"admin_endpoint,omitempty"`
 		// Secret for accessing admin API.
-		AdminSecret string `yaml:"admin_secret,omitempty"`
+		AdminSecret Secret `yaml:"admin_secret,omitempty"`
 		// Endpoint for receiving webhooks.
 		WebhookEndpoint string `yaml:"webhook_endpoint"`
 		// Public URL where the webhook endpoint is accessible. Used for installing GitHub webhooks automatically.
@@ -41,6 +44,13 @@ type Config struct {
 		CIWebhookEndpoint string `yaml:"ci_webhook_endpoint"`
 		// Public URL where the CI webhook endpoint is accessible. Used for installing GitLab webhooks automatically.
 		CIWebhookPublicURL string `yaml:"ci_webhook_public_url,omitempty"`
+		// Endpoint for receiving job status from other CI systems. Requests are authenticated with the status token of the CI repository.
+		CIStatusEndpoint string `yaml:"ci_status_endpoint,omitempty"`
+		// Endpoint for receiving check run and workflow run webhooks from GitHub, for mirroring
+		// the status of GitHub Actions to GitLab.
+		GitHubCIWebhookEndpoint string `yaml:"github_ci_webhook_endpoint,omitempty"`
+		// Endpoint for receiving GitHub app webhooks, used for re-running GitLab jobs from GitHub.
+		AppWebhookEndpoint string `yaml:"app_webhook_endpoint,omitempty"`
 
 		// Whether or not to trust X-Forwarded-For headers for logging.
 		TrustForwardHeaders bool `yaml:"trust_forward_headers,omitempty"`
@@ -53,9 +63,29 @@ type Config struct {
 		// The numeric app ID.
 		ID int64 `yaml:"id"`
 		// RSA private key for the app
-		PrivateKey string `yaml:"private_key"`
+		PrivateKey Secret `yaml:"private_key"`
+		// Webhook secret of the app. Required for receiving app webhooks.
+		WebhookSecret Secret `yaml:"webhook_secret,omitempty"`
 	} `yaml:"github_app"`
 
+	// Cache for the GitHub check suite and check run IDs of GitLab pipelines and jobs. IDs that aren't cached
+	// are read from the database, or found through the Checks API using the job ID as the external ID.
+	CICache struct {
+		// Maximum number of entries in each cache.
+		Size int `yaml:"size,omitempty"`
+		// Seconds after which cached IDs expire.
+		TTL int `yaml:"ttl,omitempty"`
+	} `yaml:"ci_cache,omitempty"`
+
+	// Reconciliation of GitLab pipelines with GitHub check runs, for catching up on events that were missed
+	// while maumirror was down. Only CI repositories with the GitLab API configured are reconciled.
+	CIReconcile struct {
+		// Whether to reconcile all CI repositories on startup.
+		OnStartup bool `yaml:"on_startup,omitempty"`
+		// How far back to look for updated pipelines in seconds. Defaults to 24 hours.
+		Window int `yaml:"window,omitempty"`
+	} `yaml:"ci_reconcile,omitempty"`
+
 	// Shell configuration
 	Shell struct {
 		// The command to start shells with
@@ -66,12 +96,37 @@ type Config struct {
 		Scripts struct {
 			Push *Script `yaml:"push,omitempty"`
 		} `yaml:"scripts,omitempty"`
+		// Default timeout for mirror jobs in seconds. Zero means no timeout.
+		Timeout int `yaml:"timeout,omitempty"`
+		// Resource limits for mirror scripts.
+		Limits ResourceLimits `yaml:"limits,omitempty"`
 	} `yaml:"shell"`
 
-	// Repository configuration
+	// SSH host key verification configuration
+	SSH struct {
+		// Host key checking mode. "strict" only accepts keys that are pinned or approved through the admin API,
+		// "tofu" trusts and saves the key of hosts that haven't been seen before.
+		HostKeyMode string `yaml:"host_key_mode"`
+		// Pinned host keys, written to <datadir>/known_hosts on startup. The map key is the host name
+		// ([host]:port for non-standard ports) and the values are keys in "<type> <base64 key>" format.
+		HostKeys map[string][]string `yaml:"host_keys,omitempty"`
+	} `yaml:"ssh"`
+
+	// Repository configuration. Repositories are stored in the database, any entries here are imported on startup.
 	Repositories map[string]*Repository `yaml:"repositories"`
-	// Reverse repository configuration for mirroring CI status back to GitHub.
+	// Reverse repository configuration for mirroring CI status back to GitHub. Imported into the database like repositories.
 	CIRepositories map[int64]*CIRepository `yaml:"ci_repositories"`
+	// Repositories whose GitHub Actions status is mirrored to GitLab commit statuses. The key is the GitHub repo (owner/name).
+	GitHubCIRepositories map[string]*GitHubCIRepository `yaml:"github_ci_repositories,omitempty"`
+}
+
+type ResourceLimits struct {
+	// Maximum CPU time in seconds.
+	CPUTime int `yaml:"cpu_time,omitempty"`
+	// Maximum virtual memory in megabytes.
+	Memory int `yaml:"memory,omitempty"`
+	// Niceness to run the script process group with.
+	Niceness int `yaml:"niceness,omitempty"`
 }
 
 type Script struct {
@@ -94,11 +149,6 @@ func (script *Script) UnmarshalYAML(unmarshal func(interface{}) error) error {
 }
 
 func (script *Script) MarshalYAML() (interface{}, error) {
-	if len(script.Path) > 0 {
-		if err := os.WriteFile(script.Path, []byte(script.Data), 0644); err != nil {
-			return nil, err
-		}
-	}
 	return script.Path, nil
 }
 
@@ -106,16 +156,24 @@ type Repository struct {
 	// Repository source URL. Optional, defaults to https.
 	Source string `yaml:"source,omitempty" json:"source"`
 	// Webhook auth secret. Request signature is not checked if secret is not configured.
-	Secret string `yaml:"secret,omitempty" json:"secret"`
+	Secret Secret `yaml:"secret,omitempty" json:"secret"`
 	// Target repo URL. Required.
 	Target string `yaml:"target" json:"target"`
 	// Path to SSH key for pushing repo.
 	PushKey string `yaml:"push_key,omitempty" json:"push_key"`
 	// Path to SSH key for pulling repo. If set, source repo URL defaults to ssh instead of https.
 	PullKey string `yaml:"pull_key,omitempty" json:"pull_key"`
+	// Whether to mirror Git LFS objects too. The objects are cached in the data directory.
+	LFS bool `yaml:"lfs,omitempty" json:"lfs"`
+	// Whether to mirror the GitHub wiki repository too.
+	MirrorWiki bool `yaml:"mirror_wiki,omitempty" json:"mirror_wiki"`
+	// Target URL for the wiki repository. Defaults to the GitLab wiki of the target project.
+	WikiTarget string `yaml:"wiki_target,omitempty" json:"wiki_target"`
+	// Timeout for mirror jobs in seconds. Defaults to the global shell timeout.
+	Timeout int `yaml:"timeout,omitempty" json:"timeout"`
 
 	// GitLab CI webhook auth secret.
-	CISecret string `yaml:"ci_secret,omitempty" json:"ci_secret"`
+	CISecret Secret `yaml:"ci_secret,omitempty" json:"ci_secret"`
 	// GitHub installation ID for mirroring CI status
 	GHInstallationID int `yaml:"gh_installation_id,omitempty" json:"gh_installation_id"`
 
@@ -125,15 +183,84 @@ type Repository struct {
 
 type CIRepository struct {
 	// Webhook auth secret.
-	Secret string `yaml:"secret,omitempty" json:"secret"`
+	Secret Secret `yaml:"secret,omitempty" json:"secret"`
+	// Bearer token for sending job status through the generic CI status endpoint.
+	StatusToken Secret `yaml:"status_token,omitempty" json:"status_token"`
 	// Target GitHub repo owner and name.
 	Owner string `yaml:"owner" json:"owner"`
 	Name  string `yaml:"repo" json:"repo"`
+	// How CI status is reported: "checks" (default) creates check runs through the GitHub app, "statuses" sets
+	// GitHub commit statuses using GitHubToken and "gitea" sets commit statuses in a Gitea or Forgejo repository.
+	Mode string `yaml:"mode,omitempty" json:"mode"`
 	// GitHub app installation ID. This will be filled automatically if left empty.
 	InstallationID int64 `yaml:"installation_id" json:"installation_id"`
+	// GitHub access token for setting commit statuses in the statuses mode.
+	GitHubToken Secret `yaml:"github_token,omitempty" json:"github_token"`
+	// Gitea or Forgejo instance URL and access token for setting commit statuses in the gitea mode.
+	GiteaURL   string `yaml:"gitea_url,omitempty" json:"gitea_url"`
+	GiteaToken Secret `yaml:"gitea_token,omitempty" json:"gitea_token"`
+	// GitLab instance URL and access token for calling the GitLab API, e.g. for reconciling pipelines.
+	GitLabURL   string `yaml:"gitlab_url,omitempty" json:"gitlab_url"`
+	GitLabToken Secret `yaml:"gitlab_token,omitempty" json:"gitlab_token"`
+	// Name of the check run summarizing the whole pipeline. Defaults to "GitLab pipeline".
+	PipelineCheckName string `yaml:"pipeline_check_name,omitempty" json:"pipeline_check_name"`
+	// Number of lines from the end of the job log to include in the check run of failed jobs.
+	// Requires the GitLab API to be configured. Zero disables log excerpts.
+	LogExcerptLines int `yaml:"log_excerpt_lines,omitempty" json:"log_excerpt_lines"`
+	// Whether failed test cases from the GitLab pipeline test report should be added to check runs as annotations.
+	// Requires the GitLab API to be configured.
+	TestReportAnnotations bool `yaml:"test_report_annotations,omitempty" json:"test_report_annotations"`
+	// Whether a comment summarizing the pipeline should be kept up to date in pull requests for the commit.
+	PRComment bool `yaml:"pr_comment,omitempty" json:"pr_comment"`
+	// Whether GitLab deployments should be mirrored to GitHub deployments.
+	Deployments bool `yaml:"deployments,omitempty" json:"deployments"`
+	// Rules for which jobs get a check run and what the check runs are named.
+	Jobs JobRules `yaml:"jobs,omitempty" json:"jobs"`
+	// Go text/template overrides for the output of job check runs.
+	Output JobOutputTemplates `yaml:"output,omitempty" json:"output"`
+
+	projectID int64
+	plock     *PartitionLocker
+}
+
+type JobRules struct {
+	// If set, only jobs matching at least one of these rules are mirrored.
+	Include []JobRule `yaml:"include,omitempty" json:"include"`
+	// Jobs matching any of these rules are not mirrored, even if they match an include rule.
+	Exclude []JobRule `yaml:"exclude,omitempty" json:"exclude"`
+	// Template for check run names. {name} is replaced with the job name and {stage} with the stage name.
+	// Defaults to "{name}".
+	NameTemplate string `yaml:"name_template,omitempty" json:"name_template"`
+}
+
+// JobRule matches jobs by name, stage and/or a regex. All fields that are set must match.
+type JobRule struct {
+	// Exact job name.
+	Name string `yaml:"name,omitempty" json:"name"`
+	// Exact stage name.
+	Stage string `yaml:"stage,omitempty" json:"stage"`
+	// Regex that must match the job name.
+	Regex string `yaml:"regex,omitempty" json:"regex"`
+
+	regex *regexp.Regexp
+}
+
+// JobOutputTemplates are the templates for the title, summary and text of job check runs.
+// Templates that are not set keep the default output. See JobOutputTemplateData for the available fields.
+type JobOutputTemplates struct {
+	Title   string `yaml:"title,omitempty" json:"title"`
+	Summary string `yaml:"summary,omitempty" json:"summary"`
+	Text    string `yaml:"text,omitempty" json:"text"`
+
+	title, summary, text *template.Template
+}
 
-	plock         *PartitionLocker
-	mapLock       sync.RWMutex
-	checkSuiteIDs map[string]int64
-	checkRunIDs   map[int64]int64
+type GitHubCIRepository struct {
+	// Webhook secret for verifying GitHub webhook signatures.
+	Secret Secret `yaml:"secret" json:"secret"`
+	// Target GitLab project ID.
+	ProjectID int64 `yaml:"project_id" json:"project_id"`
+	// GitLab instance URL and access token for setting commit statuses.
+	GitLabURL   string `yaml:"gitlab_url" json:"gitlab_url"`
+	GitLabToken Secret `yaml:"gitlab_token" json:"gitlab_token"`
 }
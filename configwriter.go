@@ -0,0 +1,171 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"gopkg.in/yaml.v3"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// Number of old config files to keep as <config>.bak.N
+const configBackupCount = 3
+
+// configLock serializes changes to the config file and guards the repository maps. Code that may run
+// concurrently with changes must read the maps through getRepository, getCIRepository and friends.
+var configLock sync.RWMutex
+
+// writeConfig writes the config to the given path, preserving the comments and key order of the existing file.
+// The new file is written to a temporary file and renamed over the old one, so a crash can't leave a partial config.
+func writeConfig(path string, cfg *Config) error {
+	var newNode yaml.Node
+	if err := newNode.Encode(cfg); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	}
+
+	oldData, err := os.ReadFile(path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("failed to read old config: %w", err)
+	}
+	var oldDoc yaml.Node
+	if len(oldData) > 0 {
+		if err = yaml.Unmarshal(oldData, &oldDoc); err != nil {
+			return fmt.Errorf("failed to parse old config: %w", err)
+		}
+	}
+	doc := &newNode
+	if oldDoc.Kind == yaml.DocumentNode && len(oldDoc.Content) == 1 {
+		oldDoc.Content[0] = mergeYAMLNode(oldDoc.Content[0], &newNode)
+		doc = &oldDoc
+	}
+
+	var buf bytes.Buffer
+	enc := yaml.NewEncoder(&buf)
+	enc.SetIndent(4)
+	if err = enc.Encode(doc); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	} else if err = enc.Close(); err != nil {
+		return fmt.Errorf("failed to marshal config: %w", err)
+	} else if bytes.Equal(buf.Bytes(), oldData) {
+		return nil
+	}
+
+	tmp, err := os.CreateTemp(filepath.Dir(path), "."+filepath.Base(path)+".*.tmp")
+	if err != nil {
+		return fmt.Errorf("failed to create temporary file: %w", err)
+	}
+	defer func() {
+		// This will fail if the rename was successful
+		_ = os.Remove(tmp.Name())
+	}()
+	if _, err = tmp.Write(buf.Bytes()); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to write temporary file: %w", err)
+	} else if err = tmp.Chmod(0600); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to chmod temporary file: %w", err)
+	} else if err = tmp.Sync(); err != nil {
+		_ = tmp.Close()
+		return fmt.Errorf("failed to sync temporary file: %w", err)
+	} else if err = tmp.Close(); err != nil {
+		return fmt.Errorf("failed to close temporary file: %w", err)
+	}
+
+	if len(oldData) > 0 {
+		if err = rotateConfigBackups(path, oldData); err != nil {
+			log.Warnln("Failed to back up old config:", err)
+		}
+	}
+	if err = os.Rename(tmp.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace config: %w", err)
+	}
+	return nil
+}
+
+func rotateConfigBackups(path string, oldData []byte) error {
+	for i := configBackupCount - 1; i > 0; i-- {
+		err := os.Rename(fmt.Sprintf("%s.bak.%d", path, i), fmt.Sprintf("%s.bak.%d", path, i+1))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	return os.WriteFile(path+".bak.1", oldData, 0600)
+}
+
+func isEmptyYAMLNode(node *yaml.Node) bool {
+	switch node.Kind {
+	case yaml.ScalarNode:
+		return node.Tag == "!!null" || node.Value == "" || node.Value == "0" || node.Value == "false"
+	case yaml.MappingNode, yaml.SequenceNode:
+		return len(node.Content) == 0
+	default:
+		return false
+	}
+}
+
+// mergeYAMLNode returns the new node with comments and formatting carried over from the old node.
+// Map keys keep their old order, new keys are appended and removed keys are dropped, unless the
+// old value was empty (e.g. an explicit null that the new config omits).
+func mergeYAMLNode(old, new *yaml.Node) *yaml.Node {
+	if old.Kind != new.Kind {
+		new.HeadComment, new.LineComment, new.FootComment = old.HeadComment, old.LineComment, old.FootComment
+		return new
+	}
+	switch new.Kind {
+	case yaml.ScalarNode:
+		if old.Value == new.Value && old.ShortTag() == new.ShortTag() || isEmptyYAMLNode(old) && isEmptyYAMLNode(new) {
+			return old
+		}
+		new.HeadComment, new.LineComment, new.FootComment = old.HeadComment, old.LineComment, old.FootComment
+		return new
+	case yaml.MappingNode:
+		newValues := make(map[string]*yaml.Node, len(new.Content)/2)
+		newKeys := make([]*yaml.Node, 0, len(new.Content)/2)
+		for i := 0; i+1 < len(new.Content); i += 2 {
+			newValues[new.Content[i].Value] = new.Content[i+1]
+			newKeys = append(newKeys, new.Content[i])
+		}
+		merged := make([]*yaml.Node, 0, len(new.Content))
+		seen := make(map[string]struct{}, len(newKeys))
+		for i := 0; i+1 < len(old.Content); i += 2 {
+			key, oldValue := old.Content[i], old.Content[i+1]
+			newValue, ok := newValues[key.Value]
+			if ok {
+				merged = append(merged, key, mergeYAMLNode(oldValue, newValue))
+				seen[key.Value] = struct{}{}
+			} else if isEmptyYAMLNode(oldValue) {
+				merged = append(merged, key, oldValue)
+			}
+		}
+		for _, key := range newKeys {
+			if _, ok := seen[key.Value]; !ok {
+				merged = append(merged, key, newValues[key.Value])
+			}
+		}
+		old.Content = merged
+		return old
+	default:
+		new.HeadComment, new.LineComment, new.FootComment = old.HeadComment, old.LineComment, old.FootComment
+		return new
+	}
+}
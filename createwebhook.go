@@ -41,14 +41,14 @@ type GHCreateWebhookConfig struct {
 	InsecureSSL string `json:"insecure_ssl"`
 }
 
-func NewGHCreateWebhookPayload(secret string) GHCreateWebhookPayload {
+func NewGHCreateWebhookPayload(secret string, events []string) GHCreateWebhookPayload {
 	if secret == "" {
 		secret = RandString(50)
 	}
 	return GHCreateWebhookPayload{
 		Name:   "web",
 		Active: true,
-		Events: []string{"push"},
+		Events: events,
 		Config: GHCreateWebhookConfig{
 			URL:         config.Server.WebhookPublicURL,
 			ContentType: "json",
@@ -59,8 +59,8 @@ func NewGHCreateWebhookPayload(secret string) GHCreateWebhookPayload {
 
 const GHWebhookAPIURL = "https://api.github.com/repos/%s/hooks"
 
-func CreateGitHubWebhook(accessToken, repo, secret string) (string, error) {
-	payload := NewGHCreateWebhookPayload(secret)
+func CreateGitHubWebhook(accessToken, repo, secret string, events []string) (string, error) {
+	payload := NewGHCreateWebhookPayload(secret, events)
 	var body bytes.Buffer
 
 	log.Debugln("Creating webhook for", repo)
@@ -74,7 +74,7 @@ func CreateGitHubWebhook(accessToken, repo, secret string) (string, error) {
 		return "", fmt.Errorf("failed to send webhook create request: %w", err)
 	} else if resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return "", fmt.Errorf("unexpected HTTP status %d: %s", resp.Status, string(respBody))
+		return "", fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, string(respBody))
 	} else {
 		log.Infoln("Created webhook for", repo)
 		return payload.Config.Secret, nil
@@ -109,8 +109,9 @@ func CreateGitLabWebhook(baseURL, accessToken string, projectID int64, secret st
 
 		EnableSSLVerification: true,
 
-		JobEvents:      true,
-		PipelineEvents: true,
+		DeploymentEvents: true,
+		JobEvents:        true,
+		PipelineEvents:   true,
 	}
 	var body bytes.Buffer
 
@@ -128,7 +129,7 @@ func CreateGitLabWebhook(baseURL, accessToken string, projectID int64, secret st
 		return fmt.Errorf("failed to send webhook create request: %w", err)
 	} else if resp.StatusCode != http.StatusCreated {
 		respBody, _ := io.ReadAll(resp.Body)
-		return fmt.Errorf("unexpected HTTP status %d: %s", resp.Status, string(respBody))
+		return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, string(respBody))
 	} else {
 		return nil
 	}
@@ -0,0 +1,145 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/gitlab"
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// The webhook library doesn't support deployment events, so they're parsed manually.
+const deploymentEvents gitlab.Event = "Deployment Hook"
+
+// GLDeploymentEvent is the payload of GitLab deployment webhooks.
+type GLDeploymentEvent struct {
+	ObjectKind             string `json:"object_kind"`
+	Status                 string `json:"status"`
+	DeploymentID           int64  `json:"deployment_id"`
+	DeployableID           int64  `json:"deployable_id"`
+	DeployableURL          string `json:"deployable_url"`
+	Environment            string `json:"environment"`
+	EnvironmentTier        string `json:"environment_tier"`
+	EnvironmentExternalURL string `json:"environment_external_url"`
+	Project                struct {
+		ID     int64  `json:"id"`
+		WebURL string `json:"web_url"`
+	} `json:"project"`
+	Ref         string `json:"ref"`
+	ShortSHA    string `json:"short_sha"`
+	CommitURL   string `json:"commit_url"`
+	CommitTitle string `json:"commit_title"`
+}
+
+// SHA returns the full commit hash of the deployment. The payload only has it as a part of the commit URL.
+func (evt *GLDeploymentEvent) SHA() string {
+	if idx := strings.LastIndexByte(evt.CommitURL, '/'); idx >= 0 && len(evt.CommitURL)-idx-1 == 40 {
+		return evt.CommitURL[idx+1:]
+	}
+	return evt.ShortSHA
+}
+
+// deploymentState maps a GitLab deployment status to a GitHub deployment status state.
+// GitHub doesn't have a canceled state, so canceled deployments are marked as errored.
+func deploymentState(status string) (state, description string) {
+	switch status {
+	case "created":
+		return "queued", "Deployment created"
+	case "running":
+		return "in_progress", "Deployment running"
+	case "success":
+		return "success", "Deployment successful"
+	case "failed":
+		return "failure", "Deployment failed"
+	case "canceled":
+		return "error", "Deployment canceled"
+	default:
+		return "pending", fmt.Sprintf("Deployment %s", strings.ReplaceAll(status, "_", " "))
+	}
+}
+
+// findOrCreateDeployment returns the ID of the GitHub deployment for the GitLab deployment, creating it if necessary.
+func findOrCreateDeployment(cli *github.Client, repo *CIRepository, evt *GLDeploymentEvent) (int64, error) {
+	key := strconv.FormatInt(evt.DeploymentID, 10)
+	if id, ok := repo.getStoredMapping(bucketDeployments, key); ok {
+		return id, nil
+	}
+	autoMerge := false
+	production := evt.EnvironmentTier == "production"
+	deployment, _, err := cli.Repositories.CreateDeployment(context.Background(), repo.Owner, repo.Name, &github.DeploymentRequest{
+		Ref:       stringPtr(evt.SHA()),
+		AutoMerge: &autoMerge,
+		// The deployment already happened on GitLab, so GitHub shouldn't check commit statuses
+		RequiredContexts:      &[]string{},
+		Environment:           &evt.Environment,
+		Description:           stringPtr(fmt.Sprintf("GitLab deployment #%d", evt.DeploymentID)),
+		ProductionEnvironment: &production,
+	})
+	if err != nil {
+		return 0, err
+	}
+	repo.putStoredMapping(bucketDeployments, key, deployment.GetID())
+	log.Debugfln("Created deployment %d in %s/%s for GitLab deployment %d in %d", deployment.GetID(), repo.Owner, repo.Name, evt.DeploymentID, repo.projectID)
+	return deployment.GetID(), nil
+}
+
+// handleDeploymentEvent mirrors a GitLab deployment to a GitHub deployment and adds a status for the new state.
+func handleDeploymentEvent(repo *CIRepository, evt *GLDeploymentEvent) {
+	lockKey := fmt.Sprintf("deployment-%d", evt.DeploymentID)
+	repo.plock.Lock(lockKey)
+	defer repo.plock.Unlock(lockKey)
+	cli, err := repo.githubClient()
+	if err != nil {
+		log.Warnfln("Can't mirror GitLab deployment %d to %s/%s: %v", evt.DeploymentID, repo.Owner, repo.Name, err)
+		return
+	}
+	var deploymentID int64
+	err = retryOnRateLimit("create deployment", func() (err error) {
+		deploymentID, err = findOrCreateDeployment(cli, repo, evt)
+		return
+	})
+	if err != nil {
+		log.Errorfln("Failed to create deployment for %s/%s to %s in %s/%s: %v", evt.Ref, evt.SHA(), evt.Environment, repo.Owner, repo.Name, err)
+		return
+	}
+	state, description := deploymentState(evt.Status)
+	req := &github.DeploymentStatusRequest{
+		State:       &state,
+		Description: &description,
+		Environment: &evt.Environment,
+	}
+	if len(evt.DeployableURL) > 0 {
+		req.LogURL = &evt.DeployableURL
+	}
+	if len(evt.EnvironmentExternalURL) > 0 {
+		req.EnvironmentURL = &evt.EnvironmentExternalURL
+	}
+	err = retryOnRateLimit("set deployment status", func() error {
+		_, _, err := cli.Repositories.CreateDeploymentStatus(context.Background(), repo.Owner, repo.Name, deploymentID, req)
+		return err
+	})
+	if err != nil {
+		log.Errorfln("Failed to set status of deployment %d in %s/%s to %s: %v", deploymentID, repo.Owner, repo.Name, state, err)
+	} else {
+		log.Infofln("Successfully set status of deployment %d (%s/%s to %s) in %s/%s to %s", deploymentID, evt.Ref, evt.SHA(), evt.Environment, repo.Owner, repo.Name, state)
+	}
+}
@@ -0,0 +1,72 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+)
+
+// GiteaStatus is a commit status in the Gitea and Forgejo API.
+type GiteaStatus struct {
+	State       string `json:"state"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description"`
+	Context     string `json:"context"`
+}
+
+// giteaStatusState maps check run options to a Gitea commit status state. Gitea has the same states as GitHub,
+// plus warning, which is used for failed jobs that are allowed to fail.
+func giteaStatusState(opts *github.CreateCheckRunOptions) string {
+	if opts.GetConclusion() == conclusionNeutral {
+		return "warning"
+	}
+	return commitStatusState(opts)
+}
+
+// postGiteaStatus sets a commit status in a Gitea or Forgejo repository.
+func postGiteaStatus(repo *CIRepository, sha string, status *GiteaStatus) error {
+	data, err := json.Marshal(status)
+	if err != nil {
+		return fmt.Errorf("failed to encode request body: %w", err)
+	}
+	reqURL := fmt.Sprintf("%s/api/v1/repos/%s/%s/statuses/%s",
+		strings.TrimSuffix(repo.GiteaURL, "/"), url.PathEscape(repo.Owner), url.PathEscape(repo.Name), sha)
+	req, err := http.NewRequest(http.MethodPost, reqURL, bytes.NewReader(data))
+	if err != nil {
+		return fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("Authorization", "token "+repo.GiteaToken.Value)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strings"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// GitLab limits commit status descriptions to 255 characters.
+const maxGitLabStatusDescriptionLength = 255
+
+func (repo *GitHubCIRepository) gitlabClient() (*GitLabClient, error) {
+	return newGitLabClient(repo.GitLabURL, repo.GitLabToken)
+}
+
+// gitlabStatusState maps a GitHub check run or workflow run status and conclusion to a GitLab commit status state.
+func gitlabStatusState(status, conclusion string) string {
+	switch status {
+	case "queued", "requested", "waiting":
+		return "pending"
+	case "in_progress":
+		return "running"
+	}
+	switch conclusion {
+	case "success", "neutral":
+		return "success"
+	case "cancelled", "stale":
+		return "canceled"
+	case "skipped":
+		return "skipped"
+	default:
+		return "failed"
+	}
+}
+
+// checkGitHubCIRepository finds the config for a GitHub repo and verifies the webhook signature.
+func checkGitHubCIRepository(r *http.Request, repoName string, payload []byte) (repo *GitHubCIRepository, err error, code int) {
+	repo, ok := config.GitHubCIRepositories[repoName]
+	if !ok {
+		return nil, errors.New("unknown repository"), http.StatusNotFound
+	} else if len(repo.Secret.Value) == 0 {
+		// Anyone can sign requests with an empty secret
+		return nil, errors.New("repository has no webhook secret"), http.StatusUnauthorized
+	}
+	signature := r.Header.Get(github.SHA256SignatureHeader)
+	if len(signature) == 0 {
+		signature = r.Header.Get(github.SHA1SignatureHeader)
+	}
+	if len(signature) == 0 {
+		return nil, errors.New("missing signature header"), http.StatusUnauthorized
+	} else if err = github.ValidateSignature(signature, payload, []byte(repo.Secret.Value)); err != nil {
+		return nil, err, http.StatusUnauthorized
+	}
+	return repo, nil, http.StatusOK
+}
+
+func setGitLabCommitStatus(repo *GitHubCIRepository, sha string, status *GLCommitStatus) {
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		log.Errorfln("Can't set GitLab commit status of %s in %d: %v", sha, repo.ProjectID, err)
+		return
+	}
+	status.Description = truncateText(status.Description, maxGitLabStatusDescriptionLength)
+	err = gl.SetCommitStatus(repo.ProjectID, sha, status)
+	if err != nil && strings.Contains(err.Error(), "Cannot transition status") {
+		// GitLab doesn't allow setting the same state twice, which happens e.g. when check runs are updated while running
+		log.Debugfln("GitLab commit status %s of %s in %d is already %s", status.Name, sha, repo.ProjectID, status.State)
+	} else if err != nil {
+		log.Errorfln("Failed to set GitLab commit status %s of %s in %d: %v", status.Name, sha, repo.ProjectID, err)
+	} else {
+		log.Infofln("Successfully set GitLab commit status %s of %s in %d to %s", status.Name, sha, repo.ProjectID, status.State)
+	}
+}
+
+func handleGitHubCheckRunEvent(repo *GitHubCIRepository, evt *github.CheckRunEvent) {
+	run := evt.GetCheckRun()
+	if config.GitHubApp.ID != 0 && run.GetApp().GetID() == config.GitHubApp.ID {
+		// Don't send check runs mirrored from GitLab back to GitLab
+		return
+	}
+	targetURL := run.GetDetailsURL()
+	if len(targetURL) == 0 {
+		targetURL = run.GetHTMLURL()
+	}
+	setGitLabCommitStatus(repo, run.GetHeadSHA(), &GLCommitStatus{
+		State:       gitlabStatusState(run.GetStatus(), run.GetConclusion()),
+		Ref:         run.GetCheckSuite().GetHeadBranch(),
+		Name:        run.GetName(),
+		TargetURL:   targetURL,
+		Description: run.GetOutput().GetTitle(),
+	})
+}
+
+func handleGitHubWorkflowRunEvent(repo *GitHubCIRepository, evt *github.WorkflowRunEvent) {
+	run := evt.GetWorkflowRun()
+	setGitLabCommitStatus(repo, run.GetHeadSHA(), &GLCommitStatus{
+		State:     gitlabStatusState(run.GetStatus(), run.GetConclusion()),
+		Ref:       run.GetHeadBranch(),
+		Name:      run.GetName(),
+		TargetURL: run.GetHTMLURL(),
+	})
+}
+
+func handleGitHubCIWebhook(w http.ResponseWriter, r *http.Request) {
+	rec := newDeliveryRecorder(w, "github-ci", r.Header.Get("X-GitHub-Delivery"), r.Header.Get("X-GitHub-Event"))
+	w = rec
+	defer rec.save()
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Errorln("Handling GitHub CI webhook from", readUserIP(r), "panicked:", err)
+			debug.PrintStack()
+			w.WriteHeader(http.StatusInternalServerError)
+		}
+	}()
+
+	payload, err := io.ReadAll(r.Body)
+	if err != nil {
+		respondErr(w, r, fmt.Errorf("failed to read body: %w", err), http.StatusBadRequest)
+		return
+	}
+	rawEvt, err := github.ParseWebHook(github.WebHookType(r), payload)
+	if err != nil {
+		respondErr(w, r, err, http.StatusBadRequest)
+		return
+	}
+
+	switch evt := rawEvt.(type) {
+	case *github.PingEvent:
+		log.Infoln("Received GitHub CI webhook ping from", readUserIP(r))
+	case *github.CheckRunEvent:
+		rec.Repository = evt.GetRepo().GetFullName()
+		repo, err, code := checkGitHubCIRepository(r, rec.Repository, payload)
+		if err != nil {
+			respondErr(w, r, err, code)
+			return
+		} else if evt.GetAction() != "requested_action" {
+			handleGitHubCheckRunEvent(repo, evt)
+		}
+	case *github.WorkflowRunEvent:
+		rec.Repository = evt.GetRepo().GetFullName()
+		repo, err, code := checkGitHubCIRepository(r, rec.Repository, payload)
+		if err != nil {
+			respondErr(w, r, err, code)
+			return
+		}
+		handleGitHubWorkflowRunEvent(repo, evt)
+	default:
+		log.Debugfln("Ignoring GitHub CI event of type %T", evt)
+	}
+	w.WriteHeader(http.StatusOK)
+}
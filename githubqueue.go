@@ -0,0 +1,344 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"runtime/debug"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const (
+	// Maximum number of times a GitHub API request is retried after a transient error or a rate limit.
+	githubMaxRetries = 5
+	// Delay before the first retry after a transient error. The delay doubles for each retry.
+	githubRetryBaseDelay = time.Second
+	// How long to wait after hitting a secondary rate limit that didn't include a Retry-After header.
+	githubSecondaryLimitDelay = time.Minute
+)
+
+var githubRetries, githubRateLimitHits, checkRunUpdatesSuperseded uint64
+
+type GitHubAPIMetrics struct {
+	// Number of GitHub API requests that were retried, and how many times a rate limit was hit.
+	Retries       uint64 `json:"retries"`
+	RateLimitHits uint64 `json:"rate_limit_hits"`
+	// Number of webhook events waiting to be handled in the background.
+	QueuedEvents int `json:"queued_events"`
+	// Number of check run updates waiting to be sent, and how many were dropped because a newer update replaced them.
+	QueuedCheckRunUpdates     int    `json:"queued_check_run_updates"`
+	SupersededCheckRunUpdates uint64 `json:"superseded_check_run_updates"`
+}
+
+func getGitHubAPIMetrics() *GitHubAPIMetrics {
+	checkRunUpdates.lock.Lock()
+	queuedUpdates := len(checkRunUpdates.pending)
+	checkRunUpdates.lock.Unlock()
+	queuedEvents := 0
+	backgroundEvents.lock.Lock()
+	for _, queue := range backgroundEvents.queues {
+		queuedEvents += len(queue)
+	}
+	backgroundEvents.lock.Unlock()
+	return &GitHubAPIMetrics{
+		Retries:                   atomic.LoadUint64(&githubRetries),
+		RateLimitHits:             atomic.LoadUint64(&githubRateLimitHits),
+		QueuedEvents:              queuedEvents,
+		QueuedCheckRunUpdates:     queuedUpdates,
+		SupersededCheckRunUpdates: atomic.LoadUint64(&checkRunUpdatesSuperseded),
+	}
+}
+
+// retryTransport is a http.RoundTripper that retries GitHub API requests that failed with a transient error.
+// Rate limits are left to go-github, which turns them into *github.RateLimitError and *github.AbuseRateLimitError,
+// and the background queues, which wait until the limit resets before trying again (see rateLimitDelay).
+type retryTransport struct {
+	Base http.RoundTripper
+}
+
+func newRetryTransport(base http.RoundTripper) *retryTransport {
+	return &retryTransport{Base: base}
+}
+
+func parseRateLimitReset(resp *http.Response) time.Time {
+	reset, err := strconv.ParseInt(resp.Header.Get("X-RateLimit-Reset"), 10, 64)
+	if err != nil {
+		return time.Time{}
+	}
+	// Add a second to avoid hitting the limit again because of clock differences
+	return time.Unix(reset+1, 0)
+}
+
+// rateLimitDelay returns how long to wait before retrying a GitHub API call that failed because of a rate limit,
+// or zero if the error isn't a rate limit error.
+func rateLimitDelay(err error) time.Duration {
+	var rateLimitErr *github.RateLimitError
+	var abuseErr *github.AbuseRateLimitError
+	var errResp *github.ErrorResponse
+	switch {
+	case errors.As(err, &rateLimitErr):
+		// Add a second to avoid hitting the limit again because of clock differences
+		if delay := time.Until(rateLimitErr.Rate.Reset.Time) + time.Second; delay > time.Second {
+			return delay
+		}
+		return time.Second
+	case errors.As(err, &abuseErr):
+		if abuseErr.RetryAfter != nil && *abuseErr.RetryAfter > 0 {
+			return *abuseErr.RetryAfter
+		}
+		return githubSecondaryLimitDelay
+	case errors.As(err, &errResp) && errResp.Response != nil:
+		// go-github only recognizes secondary rate limits by an old documentation URL, and doesn't know about 429
+		resp := errResp.Response
+		isSecondaryLimit := resp.StatusCode == http.StatusForbidden && strings.Contains(strings.ToLower(errResp.Message), "secondary rate limit")
+		if resp.StatusCode != http.StatusTooManyRequests && !isSecondaryLimit {
+			return 0
+		} else if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && retryAfter > 0 {
+			return time.Duration(retryAfter) * time.Second
+		} else if resp.Header.Get("X-RateLimit-Remaining") == "0" {
+			if delay := time.Until(parseRateLimitReset(resp)); delay > 0 {
+				return delay
+			}
+			return time.Second
+		}
+		return githubSecondaryLimitDelay
+	default:
+		return 0
+	}
+}
+
+// retryOnRateLimit calls fn again after the rate limit resets if it fails because of a GitHub rate limit.
+// Waiting for the limit can take up to an hour, so this must only be used in background work like queued events.
+func retryOnRateLimit(desc string, fn func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := fn()
+		delay := rateLimitDelay(err)
+		if delay == 0 || attempt >= githubMaxRetries {
+			return err
+		}
+		atomic.AddUint64(&githubRateLimitHits, 1)
+		log.Warnfln("Hit GitHub rate limit while trying to %s, retrying in %s", desc, delay.Round(time.Second))
+		time.Sleep(delay)
+	}
+}
+
+// isRetriable checks whether a request can be retried after a server error. Requests that create something
+// are only retried if a duplicate is harmless: GitHub only shows the newest check run with a given name,
+// and the newest commit status with a given context.
+func isRetriable(req *http.Request) bool {
+	return req.Method != http.MethodPost || strings.HasSuffix(req.URL.Path, "/check-runs") ||
+		strings.Contains(req.URL.Path, "/statuses/")
+}
+
+func isTransientError(resp *http.Response) bool {
+	switch resp.StatusCode {
+	case http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	default:
+		return false
+	}
+}
+
+func (rt *retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	for attempt := 0; ; attempt++ {
+		attemptReq := req
+		if attempt > 0 && req.Body != nil {
+			body, err := req.GetBody()
+			if err != nil {
+				return nil, fmt.Errorf("failed to rewind request body for retry: %w", err)
+			}
+			attemptReq = req.Clone(req.Context())
+			attemptReq.Body = body
+		}
+		resp, err := rt.Base.RoundTrip(attemptReq)
+
+		delay := githubRetryBaseDelay << attempt
+		if err != nil {
+			if !isRetriable(req) || req.Context().Err() != nil {
+				return nil, err
+			}
+		} else if !isTransientError(resp) || !isRetriable(req) {
+			return resp, nil
+		} else if retryAfter, err := strconv.Atoi(resp.Header.Get("Retry-After")); err == nil && time.Duration(retryAfter)*time.Second > delay {
+			// Overloaded servers may say when to come back with Retry-After
+			delay = time.Duration(retryAfter) * time.Second
+		}
+		if attempt >= githubMaxRetries || (req.Body != nil && req.GetBody == nil) {
+			return resp, err
+		}
+		if resp != nil {
+			_, _ = io.Copy(io.Discard, resp.Body)
+			_ = resp.Body.Close()
+			log.Debugfln("Retrying %s %s after HTTP %d (attempt %d)", req.Method, req.URL.Path, resp.StatusCode, attempt+1)
+		} else {
+			log.Debugfln("Retrying %s %s after error: %v (attempt %d)", req.Method, req.URL.Path, err, attempt+1)
+		}
+		atomic.AddUint64(&githubRetries, 1)
+		select {
+		case <-time.After(delay):
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		}
+	}
+}
+
+// eventQueue handles webhook events in the background, so that webhook requests are answered right away
+// instead of waiting for GitHub. Events with the same key are handled one at a time in the order they came in.
+type eventQueue struct {
+	lock   sync.Mutex
+	queues map[string][]func()
+}
+
+var backgroundEvents = &eventQueue{queues: make(map[string][]func())}
+
+// queueEvent queues fn to be called in the background after the previously queued events with the same key.
+func queueEvent(key string, fn func()) {
+	q := backgroundEvents
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	queue, active := q.queues[key]
+	q.queues[key] = append(queue, fn)
+	if !active {
+		go q.process(key)
+	}
+}
+
+func (q *eventQueue) process(key string) {
+	for {
+		q.lock.Lock()
+		queue := q.queues[key]
+		if len(queue) == 0 {
+			delete(q.queues, key)
+			q.lock.Unlock()
+			return
+		}
+		q.queues[key] = queue[1:]
+		q.lock.Unlock()
+		runQueuedEvent(key, queue[0])
+	}
+}
+
+func runQueuedEvent(key string, fn func()) {
+	defer func() {
+		err := recover()
+		if err != nil {
+			log.Errorfln("Handling queued event %s panicked: %v", key, err)
+			debug.PrintStack()
+		}
+	}()
+	fn()
+}
+
+type checkRunUpdate struct {
+	cli         *github.Client
+	repo        *CIRepository
+	opts        github.CreateCheckRunOptions
+	forceCreate bool
+	lookup      bool
+	// Called after the update has been sent. Not called if the update is superseded by a newer one.
+	callback func(run *github.CheckRun, action string, err error)
+
+	rateLimitRetries int
+}
+
+// supersede makes the update replace an older update of the same check run that hasn't been sent.
+func (upd *checkRunUpdate) supersede(prev *checkRunUpdate) {
+	// If the superseded update was going to create a new check run, the new one has to do that instead
+	upd.forceCreate = upd.forceCreate || prev.forceCreate
+	upd.lookup = upd.lookup || prev.lookup
+	atomic.AddUint64(&checkRunUpdatesSuperseded, 1)
+	log.Debugfln("Dropping queued update of check run %s in %s/%s as it was superseded", prev.opts.GetExternalID(), prev.repo.Owner, prev.repo.Name)
+}
+
+// checkRunQueue sends check run updates in the background. Updates to the same check run are sent in order,
+// and updates that are still waiting when a newer one comes in are dropped, as the check run options always
+// contain the full state of the job or pipeline. Updates that hit a rate limit are retried after the limit
+// resets, unless a newer update was queued while waiting.
+type checkRunQueue struct {
+	lock    sync.Mutex
+	pending map[string]*checkRunUpdate
+	active  map[string]bool
+}
+
+var checkRunUpdates = &checkRunQueue{
+	pending: make(map[string]*checkRunUpdate),
+	active:  make(map[string]bool),
+}
+
+// queueCheckRunUpdate queues a check run to be created or updated with createOrUpdateCheckRun.
+func queueCheckRunUpdate(upd *checkRunUpdate) {
+	q := checkRunUpdates
+	key := fmt.Sprintf("%d/%s", upd.repo.projectID, upd.opts.GetExternalID())
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if prev, ok := q.pending[key]; ok {
+		upd.supersede(prev)
+	}
+	q.pending[key] = upd
+	if !q.active[key] {
+		q.active[key] = true
+		go q.process(key)
+	}
+}
+
+// requeue puts an update that hit a rate limit back in the queue, unless a newer update has replaced it.
+func (q *checkRunQueue) requeue(key string, upd *checkRunUpdate) {
+	q.lock.Lock()
+	defer q.lock.Unlock()
+	if newer, ok := q.pending[key]; ok {
+		newer.supersede(upd)
+	} else {
+		q.pending[key] = upd
+	}
+}
+
+func (q *checkRunQueue) process(key string) {
+	for {
+		q.lock.Lock()
+		upd, ok := q.pending[key]
+		if !ok {
+			delete(q.active, key)
+			q.lock.Unlock()
+			return
+		}
+		delete(q.pending, key)
+		q.lock.Unlock()
+
+		run, action, err := createOrUpdateCheckRun(upd.cli, upd.repo, upd.opts, upd.forceCreate, upd.lookup)
+		if delay := rateLimitDelay(err); delay > 0 && upd.rateLimitRetries < githubMaxRetries {
+			atomic.AddUint64(&githubRateLimitHits, 1)
+			log.Warnfln("Hit GitHub rate limit while trying to %s check run %s in %s/%s, retrying in %s", action, upd.opts.GetExternalID(), upd.repo.Owner, upd.repo.Name, delay.Round(time.Second))
+			time.Sleep(delay)
+			upd.rateLimitRetries++
+			q.requeue(key, upd)
+			continue
+		}
+		if upd.callback != nil {
+			upd.callback(run, action, err)
+		}
+	}
+}
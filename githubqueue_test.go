@@ -0,0 +1,207 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+)
+
+func makeGitHubError(status int, headers map[string]string, body string) error {
+	resp := &http.Response{
+		StatusCode: status,
+		Header:     make(http.Header),
+		Body:       io.NopCloser(strings.NewReader(body)),
+		Request:    httptest.NewRequest(http.MethodPost, "https://api.github.com/repos/owner/repo/check-runs", nil),
+	}
+	for key, value := range headers {
+		resp.Header.Set(key, value)
+	}
+	return github.CheckResponse(resp)
+}
+
+func TestRateLimitDelay(t *testing.T) {
+	inOneMinute := strconv.FormatInt(time.Now().Add(time.Minute).Unix(), 10)
+	inThePast := strconv.FormatInt(time.Now().Add(-time.Minute).Unix(), 10)
+	tests := []struct {
+		name     string
+		err      error
+		min, max time.Duration
+	}{
+		{"no error", nil, 0, 0},
+		{"other error", errors.New("connection refused"), 0, 0},
+		{"not found", makeGitHubError(http.StatusNotFound, nil, `{"message": "Not Found"}`), 0, 0},
+		{"permission error", makeGitHubError(http.StatusForbidden, nil, `{"message": "Resource not accessible by integration"}`), 0, 0},
+		{
+			"primary limit",
+			makeGitHubError(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": inOneMinute}, `{"message": "API rate limit exceeded"}`),
+			55 * time.Second, 62 * time.Second,
+		},
+		{
+			"primary limit already reset",
+			makeGitHubError(http.StatusForbidden, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": inThePast}, `{"message": "API rate limit exceeded"}`),
+			time.Second, time.Second,
+		},
+		{
+			"abuse limit with Retry-After",
+			makeGitHubError(http.StatusForbidden, map[string]string{"Retry-After": "30"}, `{"message": "slow down", "documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#abuse-rate-limits"}`),
+			30 * time.Second, 30 * time.Second,
+		},
+		{
+			"abuse limit without Retry-After",
+			makeGitHubError(http.StatusForbidden, nil, `{"message": "slow down", "documentation_url": "https://docs.github.com/rest/overview/resources-in-the-rest-api#abuse-rate-limits"}`),
+			githubSecondaryLimitDelay, githubSecondaryLimitDelay,
+		},
+		{
+			"secondary limit with Retry-After",
+			makeGitHubError(http.StatusForbidden, map[string]string{"Retry-After": "20"}, `{"message": "You have exceeded a secondary rate limit. Please wait a few minutes before you try again."}`),
+			20 * time.Second, 20 * time.Second,
+		},
+		{
+			"secondary limit without Retry-After",
+			makeGitHubError(http.StatusForbidden, nil, `{"message": "You have exceeded a secondary rate limit."}`),
+			githubSecondaryLimitDelay, githubSecondaryLimitDelay,
+		},
+		{
+			"too many requests",
+			makeGitHubError(http.StatusTooManyRequests, nil, `{"message": "Too many requests"}`),
+			githubSecondaryLimitDelay, githubSecondaryLimitDelay,
+		},
+		{
+			"too many requests with reset",
+			makeGitHubError(http.StatusTooManyRequests, map[string]string{"X-RateLimit-Remaining": "0", "X-RateLimit-Reset": inOneMinute}, `{"message": "Too many requests"}`),
+			55 * time.Second, 62 * time.Second,
+		},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if delay := rateLimitDelay(test.err); delay < test.min || delay > test.max {
+				t.Errorf("rateLimitDelay(%v) = %s, expected between %s and %s", test.err, delay, test.min, test.max)
+			}
+		})
+	}
+}
+
+func setTestCheckRunQueue(t *testing.T) *checkRunQueue {
+	prev := checkRunUpdates
+	checkRunUpdates = &checkRunQueue{
+		pending: make(map[string]*checkRunUpdate),
+		active:  make(map[string]bool),
+	}
+	t.Cleanup(func() { checkRunUpdates = prev })
+	return checkRunUpdates
+}
+
+func makeTestCheckRunUpdate(externalID string, forceCreate, lookup bool) *checkRunUpdate {
+	return &checkRunUpdate{
+		repo:        &CIRepository{Owner: "owner", Name: "repo", projectID: 1},
+		opts:        github.CreateCheckRunOptions{Name: "test", ExternalID: &externalID},
+		forceCreate: forceCreate,
+		lookup:      lookup,
+	}
+}
+
+func TestCheckRunQueueCollapsesUpdates(t *testing.T) {
+	q := setTestCheckRunQueue(t)
+	// Pretend the updates of the first job are being sent, so that the queued ones stay pending
+	q.active["1/10"] = true
+	superseded := atomic.LoadUint64(&checkRunUpdatesSuperseded)
+
+	queueCheckRunUpdate(makeTestCheckRunUpdate("10", true, false))
+	queueCheckRunUpdate(makeTestCheckRunUpdate("10", false, true))
+	newest := makeTestCheckRunUpdate("10", false, false)
+	queueCheckRunUpdate(newest)
+
+	if len(q.pending) != 1 || q.pending["1/10"] != newest {
+		t.Fatalf("expected only the newest update to be pending, got %v", q.pending)
+	} else if !newest.forceCreate || !newest.lookup {
+		t.Errorf("newest update didn't inherit flags of superseded updates: forceCreate=%t, lookup=%t", newest.forceCreate, newest.lookup)
+	} else if dropped := atomic.LoadUint64(&checkRunUpdatesSuperseded) - superseded; dropped != 2 {
+		t.Errorf("expected 2 superseded updates, got %d", dropped)
+	}
+}
+
+func TestCheckRunQueueRequeue(t *testing.T) {
+	q := setTestCheckRunQueue(t)
+
+	limited := makeTestCheckRunUpdate("10", false, true)
+	q.requeue("1/10", limited)
+	if q.pending["1/10"] != limited {
+		t.Errorf("rate limited update wasn't requeued")
+	}
+
+	newer := makeTestCheckRunUpdate("11", false, false)
+	q.pending["1/11"] = newer
+	q.requeue("1/11", makeTestCheckRunUpdate("11", true, true))
+	if q.pending["1/11"] != newer {
+		t.Errorf("rate limited update replaced a newer update")
+	} else if !newer.forceCreate || !newer.lookup {
+		t.Errorf("newer update didn't inherit flags of the rate limited update: forceCreate=%t, lookup=%t", newer.forceCreate, newer.lookup)
+	}
+}
+
+func TestEventQueueOrder(t *testing.T) {
+	prev := backgroundEvents
+	backgroundEvents = &eventQueue{queues: make(map[string][]func())}
+	t.Cleanup(func() { backgroundEvents = prev })
+
+	results := make(chan int, 10)
+	release := make(chan struct{})
+	queueEvent("1/abc", func() {
+		<-release
+		results <- 0
+	})
+	for i := 1; i < 5; i++ {
+		i := i
+		queueEvent("1/abc", func() {
+			if i == 2 {
+				panic("handler failed")
+			}
+			results <- i
+		})
+	}
+	queueEvent("1/def", func() { results <- 10 })
+	// Events of other commits don't wait for the blocked one
+	select {
+	case result := <-results:
+		if result != 10 {
+			t.Fatalf("got result %d from blocked queue", result)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("event of another commit wasn't handled")
+	}
+	close(release)
+	for _, expected := range []int{0, 1, 3, 4} {
+		select {
+		case result := <-results:
+			if result != expected {
+				t.Fatalf("got result %d, expected %d", result, expected)
+			}
+		case <-time.After(5 * time.Second):
+			t.Fatalf("timed out waiting for result %d", expected)
+		}
+	}
+}
@@ -0,0 +1,465 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/gitlab"
+)
+
+var ErrGitLabAPINotConfigured = errors.New("GitLab API URL and token are not configured")
+
+// Maximum number of pages to fetch from list endpoints.
+const gitlabMaxPages = 10
+
+type GitLabClient struct {
+	BaseURL string
+	Token   string
+}
+
+func newGitLabClient(baseURL string, token Secret) (*GitLabClient, error) {
+	if len(baseURL) == 0 || len(token.Value) == 0 {
+		return nil, ErrGitLabAPINotConfigured
+	}
+	return &GitLabClient{
+		BaseURL: strings.TrimSuffix(baseURL, "/"),
+		Token:   token.Value,
+	}, nil
+}
+
+func (repo *CIRepository) gitlabClient() (*GitLabClient, error) {
+	return newGitLabClient(repo.GitLabURL, repo.GitLabToken)
+}
+
+func (gl *GitLabClient) newRequest(method, path string, query url.Values, body interface{}) (*http.Request, error) {
+	var reqBody io.Reader
+	if body != nil {
+		data, err := json.Marshal(body)
+		if err != nil {
+			return nil, fmt.Errorf("failed to encode request body: %w", err)
+		}
+		reqBody = bytes.NewReader(data)
+	}
+	reqURL := fmt.Sprintf("%s/api/v4/%s", gl.BaseURL, path)
+	if len(query) > 0 {
+		reqURL += "?" + query.Encode()
+	}
+	req, err := http.NewRequest(method, reqURL, reqBody)
+	if err != nil {
+		return nil, fmt.Errorf("failed to create request: %w", err)
+	}
+	req.Header.Set("PRIVATE-TOKEN", gl.Token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+	return req, nil
+}
+
+func (gl *GitLabClient) requestRaw(method, path string, query url.Values, body interface{}) ([]byte, error) {
+	req, err := gl.newRequest(method, path, query, body)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	respBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read response: %w", err)
+	} else if resp.StatusCode >= 300 {
+		return nil, fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	return respBody, nil
+}
+
+func (gl *GitLabClient) request(method, path string, query url.Values, body, out interface{}) error {
+	respBody, err := gl.requestRaw(method, path, query, body)
+	if err != nil {
+		return err
+	} else if out != nil {
+		if err = json.Unmarshal(respBody, out); err != nil {
+			return fmt.Errorf("failed to parse response: %w", err)
+		}
+	}
+	return nil
+}
+
+type GLPipeline struct {
+	ID        int64     `json:"id"`
+	SHA       string    `json:"sha"`
+	Ref       string    `json:"ref"`
+	Status    string    `json:"status"`
+	WebURL    string    `json:"web_url"`
+	CreatedAt time.Time `json:"created_at"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+// ToEvent converts the pipeline and its jobs into the webhook payload format.
+func (pipeline *GLPipeline) ToEvent(projectID int64, jobs []GLJob) gitlab.PipelineEventPayload {
+	evt := gitlab.PipelineEventPayload{
+		ObjectKind: "pipeline",
+		Project: gitlab.Project{
+			ID:     projectID,
+			WebURL: strings.TrimSuffix(pipeline.WebURL, fmt.Sprintf("/-/pipelines/%d", pipeline.ID)),
+		},
+		ObjectAttributes: gitlab.PipelineObjectAttributes{
+			ID:     pipeline.ID,
+			Ref:    pipeline.Ref,
+			SHA:    pipeline.SHA,
+			Status: pipeline.Status,
+		},
+		Builds: make([]gitlab.Build, len(jobs)),
+	}
+	evt.ObjectAttributes.CreatedAt.Time = pipeline.CreatedAt
+	// The job list is newest first, so go through it backwards to get the stages in order
+	seenStages := make(map[string]struct{})
+	for i := len(jobs) - 1; i >= 0; i-- {
+		job := &jobs[i]
+		if _, seen := seenStages[job.Stage]; !seen {
+			seenStages[job.Stage] = struct{}{}
+			evt.ObjectAttributes.Stages = append(evt.ObjectAttributes.Stages, job.Stage)
+		}
+		build := gitlab.Build{
+			ID:     job.ID,
+			Stage:  job.Stage,
+			Name:   job.Name,
+			Status: job.Status,
+		}
+		if job.StartedAt != nil {
+			build.StartedAt.Time = *job.StartedAt
+		}
+		if job.FinishedAt != nil {
+			build.FinishedAt.Time = *job.FinishedAt
+			if job.FinishedAt.After(evt.ObjectAttributes.FinishedAt.Time) {
+				evt.ObjectAttributes.FinishedAt.Time = *job.FinishedAt
+			}
+		}
+		evt.Builds[i] = build
+	}
+	return evt
+}
+
+// JobEvent is a GitLab job webhook payload, including fields that the webhook library doesn't parse.
+type JobEvent struct {
+	gitlab.JobEventPayload
+	// Time in seconds that the job waited for a runner.
+	BuildQueuedDuration float64        `json:"build_queued_duration"`
+	Environment         *GLEnvironment `json:"environment"`
+}
+
+type GLEnvironment struct {
+	Name           string `json:"name"`
+	Action         string `json:"action"`
+	DeploymentTier string `json:"deployment_tier"`
+}
+
+type GLJob struct {
+	ID             int64      `json:"id"`
+	Name           string     `json:"name"`
+	Stage          string     `json:"stage"`
+	Status         string     `json:"status"`
+	Ref            string     `json:"ref"`
+	Tag            bool       `json:"tag"`
+	StartedAt      *time.Time `json:"started_at"`
+	FinishedAt     *time.Time `json:"finished_at"`
+	Duration       float64    `json:"duration"`
+	QueuedDuration float64    `json:"queued_duration"`
+	AllowFailure   bool       `json:"allow_failure"`
+	FailureReason  string     `json:"failure_reason"`
+	WebURL         string     `json:"web_url"`
+
+	Pipeline struct {
+		ID  int64  `json:"id"`
+		SHA string `json:"sha"`
+	} `json:"pipeline"`
+	Commit struct {
+		ID          string `json:"id"`
+		Message     string `json:"message"`
+		AuthorName  string `json:"author_name"`
+		AuthorEmail string `json:"author_email"`
+	} `json:"commit"`
+	User struct {
+		ID        int64  `json:"id"`
+		Name      string `json:"name"`
+		Username  string `json:"username"`
+		AvatarURL string `json:"avatar_url"`
+	} `json:"user"`
+	Runner *struct {
+		ID          int64  `json:"id"`
+		Description string `json:"description"`
+		Active      bool   `json:"active"`
+		IsShared    bool   `json:"is_shared"`
+	} `json:"runner"`
+}
+
+// ToEvent converts the job into the webhook payload format, so API responses can be handled like webhooks.
+func (job *GLJob) ToEvent(projectID int64) JobEvent {
+	evt := JobEvent{BuildQueuedDuration: job.QueuedDuration}
+	evt.JobEventPayload = gitlab.JobEventPayload{
+		ObjectKind:         "build",
+		Ref:                job.Ref,
+		Tag:                job.Tag,
+		SHA:                job.Pipeline.SHA,
+		BuildID:            job.ID,
+		BuildName:          job.Name,
+		BuildStage:         job.Stage,
+		BuildStatus:        job.Status,
+		BuildDuration:      job.Duration,
+		BuildAllowFailure:  job.AllowFailure,
+		BuildFailureReason: job.FailureReason,
+		PipelineID:         job.Pipeline.ID,
+		ProjectID:          projectID,
+		User: gitlab.User{
+			ID:        job.User.ID,
+			Name:      job.User.Name,
+			UserName:  job.User.Username,
+			AvatarURL: job.User.AvatarURL,
+		},
+		Commit: gitlab.BuildCommit{
+			SHA:         job.Commit.ID,
+			Message:     job.Commit.Message,
+			AuthorName:  job.Commit.AuthorName,
+			AuthorEmail: job.Commit.AuthorEmail,
+		},
+		Repository: gitlab.Repository{
+			Homepage: strings.TrimSuffix(job.WebURL, fmt.Sprintf("/-/jobs/%d", job.ID)),
+		},
+	}
+	if job.StartedAt != nil {
+		evt.BuildStartedAt.Time = *job.StartedAt
+	}
+	if job.FinishedAt != nil {
+		evt.BuildFinishedAt.Time = *job.FinishedAt
+	}
+	if job.Runner != nil {
+		evt.Runner = gitlab.Runner{
+			ID:          job.Runner.ID,
+			Description: job.Runner.Description,
+			Active:      job.Runner.Active,
+			IsShared:    job.Runner.IsShared,
+		}
+	}
+	return evt
+}
+
+// ListPipelines returns the pipelines of a project that have been updated after the given time.
+func (gl *GitLabClient) ListPipelines(projectID int64, updatedAfter time.Time) ([]GLPipeline, error) {
+	var pipelines []GLPipeline
+	for page := 1; page <= gitlabMaxPages; page++ {
+		var batch []GLPipeline
+		query := url.Values{
+			"updated_after": {updatedAfter.UTC().Format(time.RFC3339)},
+			"order_by":      {"updated_at"},
+			"per_page":      {"100"},
+			"page":          {strconv.Itoa(page)},
+		}
+		if err := gl.request(http.MethodGet, fmt.Sprintf("projects/%d/pipelines", projectID), query, nil, &batch); err != nil {
+			return pipelines, err
+		}
+		pipelines = append(pipelines, batch...)
+		if len(batch) < 100 {
+			break
+		}
+	}
+	return pipelines, nil
+}
+
+// GetPipeline returns a single pipeline.
+func (gl *GitLabClient) GetPipeline(projectID, pipelineID int64) (*GLPipeline, error) {
+	var pipeline GLPipeline
+	err := gl.request(http.MethodGet, fmt.Sprintf("projects/%d/pipelines/%d", projectID, pipelineID), nil, nil, &pipeline)
+	return &pipeline, err
+}
+
+// ListPipelineJobs returns the latest jobs of a pipeline (i.e. not including retried jobs).
+func (gl *GitLabClient) ListPipelineJobs(projectID, pipelineID int64) ([]GLJob, error) {
+	var jobs []GLJob
+	for page := 1; page <= gitlabMaxPages; page++ {
+		var batch []GLJob
+		query := url.Values{
+			"per_page": {"100"},
+			"page":     {strconv.Itoa(page)},
+		}
+		if err := gl.request(http.MethodGet, fmt.Sprintf("projects/%d/pipelines/%d/jobs", projectID, pipelineID), query, nil, &batch); err != nil {
+			return jobs, err
+		}
+		jobs = append(jobs, batch...)
+		if len(batch) < 100 {
+			break
+		}
+	}
+	return jobs, nil
+}
+
+// tailBuffer is an io.Writer that only keeps the last len(buf) bytes written to it.
+type tailBuffer struct {
+	buf     []byte
+	pos     int
+	wrapped bool
+}
+
+func (tb *tailBuffer) Write(data []byte) (int, error) {
+	n := len(data)
+	if len(data) >= len(tb.buf) {
+		copy(tb.buf, data[len(data)-len(tb.buf):])
+		tb.pos = 0
+		tb.wrapped = true
+		return n, nil
+	}
+	copied := copy(tb.buf[tb.pos:], data)
+	copy(tb.buf, data[copied:])
+	if tb.pos+len(data) >= len(tb.buf) {
+		tb.wrapped = true
+	}
+	tb.pos = (tb.pos + len(data)) % len(tb.buf)
+	return n, nil
+}
+
+func (tb *tailBuffer) Bytes() []byte {
+	if !tb.wrapped {
+		return tb.buf[:tb.pos]
+	}
+	return append(append([]byte{}, tb.buf[tb.pos:]...), tb.buf[:tb.pos]...)
+}
+
+// GetJobTraceTail returns at most the last maxSize bytes of the raw log of a job. If the log was cut,
+// the first partial line is dropped. Only the tail is requested, and if the server ignores the range,
+// the response is streamed so that huge logs aren't buffered in memory.
+func (gl *GitLabClient) GetJobTraceTail(projectID, jobID int64, maxSize int) (string, error) {
+	req, err := gl.newRequest(http.MethodGet, fmt.Sprintf("projects/%d/jobs/%d/trace", projectID, jobID), nil, nil)
+	if err != nil {
+		return "", err
+	}
+	req.Header.Set("Range", fmt.Sprintf("bytes=-%d", maxSize))
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		return "", fmt.Errorf("failed to send request: %w", err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		// Empty logs can't satisfy any range
+		return "", nil
+	} else if resp.StatusCode >= 300 {
+		respBody, _ := io.ReadAll(io.LimitReader(resp.Body, 4096))
+		return "", fmt.Errorf("unexpected HTTP status %s: %s", resp.Status, strings.TrimSpace(string(respBody)))
+	}
+	tail := &tailBuffer{buf: make([]byte, maxSize)}
+	var total int64
+	if total, err = io.Copy(tail, resp.Body); err != nil {
+		return "", fmt.Errorf("failed to read response: %w", err)
+	}
+	trace := tail.Bytes()
+	truncated := total > int64(maxSize)
+	if resp.StatusCode == http.StatusPartialContent {
+		truncated = !strings.HasPrefix(resp.Header.Get("Content-Range"), "bytes 0-")
+	}
+	if truncated {
+		if idx := bytes.IndexByte(trace, '\n'); idx >= 0 {
+			trace = trace[idx+1:]
+		}
+	}
+	return string(trace), nil
+}
+
+// RetryJob retries a finished job. GitLab creates a new job with a different ID for the retry.
+func (gl *GitLabClient) RetryJob(projectID, jobID int64) (*GLJob, error) {
+	var job GLJob
+	err := gl.request(http.MethodPost, fmt.Sprintf("projects/%d/jobs/%d/retry", projectID, jobID), nil, nil, &job)
+	return &job, err
+}
+
+// PlayJob starts a manual job.
+func (gl *GitLabClient) PlayJob(projectID, jobID int64) (*GLJob, error) {
+	var job GLJob
+	err := gl.request(http.MethodPost, fmt.Sprintf("projects/%d/jobs/%d/play", projectID, jobID), nil, nil, &job)
+	return &job, err
+}
+
+// RetryPipeline retries the failed and canceled jobs of a pipeline.
+func (gl *GitLabClient) RetryPipeline(projectID, pipelineID int64) (*GLPipeline, error) {
+	var pipeline GLPipeline
+	err := gl.request(http.MethodPost, fmt.Sprintf("projects/%d/pipelines/%d/retry", projectID, pipelineID), nil, nil, &pipeline)
+	return &pipeline, err
+}
+
+// CreatePipeline starts a new pipeline for the current head of the given branch or tag.
+func (gl *GitLabClient) CreatePipeline(projectID int64, ref string) (*GLPipeline, error) {
+	var pipeline GLPipeline
+	err := gl.request(http.MethodPost, fmt.Sprintf("projects/%d/pipeline", projectID), url.Values{"ref": {ref}}, nil, &pipeline)
+	return &pipeline, err
+}
+
+type GLCommitStatus struct {
+	State       string `json:"state"`
+	Ref         string `json:"ref,omitempty"`
+	Name        string `json:"name"`
+	TargetURL   string `json:"target_url,omitempty"`
+	Description string `json:"description,omitempty"`
+}
+
+// SetCommitStatus adds or updates a commit status, which GitLab shows as an external pipeline job.
+func (gl *GitLabClient) SetCommitStatus(projectID int64, sha string, status *GLCommitStatus) error {
+	return gl.request(http.MethodPost, fmt.Sprintf("projects/%d/statuses/%s", projectID, sha), nil, status, nil)
+}
+
+type GLTestCase struct {
+	Status        string  `json:"status"`
+	Name          string  `json:"name"`
+	Classname     string  `json:"classname"`
+	File          string  `json:"file"`
+	ExecutionTime float64 `json:"execution_time"`
+	SystemOutput  string  `json:"system_output"`
+	StackTrace    string  `json:"stack_trace"`
+}
+
+type GLTestSuite struct {
+	Name         string       `json:"name"`
+	TotalCount   int          `json:"total_count"`
+	SuccessCount int          `json:"success_count"`
+	FailedCount  int          `json:"failed_count"`
+	SkippedCount int          `json:"skipped_count"`
+	ErrorCount   int          `json:"error_count"`
+	TestCases    []GLTestCase `json:"test_cases"`
+}
+
+type GLTestReport struct {
+	TotalCount   int           `json:"total_count"`
+	SuccessCount int           `json:"success_count"`
+	FailedCount  int           `json:"failed_count"`
+	SkippedCount int           `json:"skipped_count"`
+	ErrorCount   int           `json:"error_count"`
+	TestSuites   []GLTestSuite `json:"test_suites"`
+}
+
+// GetPipelineTestReport returns the test report GitLab has parsed from the JUnit artifacts of a pipeline.
+func (gl *GitLabClient) GetPipelineTestReport(projectID, pipelineID int64) (*GLTestReport, error) {
+	var report GLTestReport
+	err := gl.request(http.MethodGet, fmt.Sprintf("projects/%d/pipelines/%d/test_report", projectID, pipelineID), nil, nil, &report)
+	return &report, err
+}
@@ -6,7 +6,8 @@ require (
 	github.com/bradleyfalzon/ghinstallation/v2 v2.0.4-0.20211125201224-5ec0839f66cd
 	github.com/go-playground/webhooks/v6 v6.0.0-rc.1
 	github.com/google/go-github/v40 v40.0.0
-	gopkg.in/yaml.v2 v2.4.0
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 	maunium.net/go/mauflag v1.0.0
 	maunium.net/go/maulogger/v2 v2.3.2
 )
@@ -15,4 +16,5 @@ require (
 	github.com/golang-jwt/jwt/v4 v4.0.0 // indirect
 	github.com/google/go-querystring v1.1.0 // indirect
 	golang.org/x/crypto v0.0.0-20210817164053-32db794688a5 // indirect
+	golang.org/x/sys v0.0.0-20210615035016-665e8c7367d1 // indirect
 )
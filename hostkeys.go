@@ -0,0 +1,285 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"sync"
+
+	log "maunium.net/go/maulogger/v2"
+)
+
+const (
+	HostKeyModeStrict = "strict"
+	HostKeyModeTOFU   = "tofu"
+)
+
+var (
+	ErrHostKeyMismatch = errors.New("host key mismatch")
+	ErrHostKeyUnknown  = errors.New("unknown host key")
+)
+
+type HostKey struct {
+	Host string `json:"host"`
+	Type string `json:"type"`
+	Key  string `json:"key"`
+}
+
+func (hk HostKey) String() string {
+	return fmt.Sprintf("%s %s %s", hk.Host, hk.Type, hk.Key)
+}
+
+var knownHostsLock sync.Mutex
+var pendingHostKeys = make(map[string][]HostKey)
+
+func knownHostsPath() string {
+	path, err := filepath.Abs(filepath.Join(config.DataDir, "known_hosts"))
+	if err != nil {
+		return filepath.Join(config.DataDir, "known_hosts")
+	}
+	return path
+}
+
+func strictHostKeyChecking() string {
+	if config.SSH.HostKeyMode == HostKeyModeTOFU {
+		return "accept-new"
+	}
+	return "yes"
+}
+
+// readKnownHosts reads the managed known_hosts file. Lines that aren't plain host key entries
+// (comments, markers, hashed hosts) are returned separately so that they can be written back as-is.
+func readKnownHosts() (keys []HostKey, otherLines []string, err error) {
+	data, err := os.ReadFile(knownHostsPath())
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil, nil
+	} else if err != nil {
+		return nil, nil, err
+	}
+	for _, line := range strings.Split(string(data), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") || strings.HasPrefix(fields[0], "@") || strings.HasPrefix(fields[0], "|") {
+			if len(strings.TrimSpace(line)) > 0 {
+				otherLines = append(otherLines, line)
+			}
+			continue
+		}
+		for _, host := range strings.Split(fields[0], ",") {
+			keys = append(keys, HostKey{Host: host, Type: fields[1], Key: fields[2]})
+		}
+	}
+	return
+}
+
+func writeKnownHosts(keys []HostKey, otherLines []string) error {
+	var buf bytes.Buffer
+	for _, line := range otherLines {
+		buf.WriteString(line)
+		buf.WriteByte('\n')
+	}
+	for _, key := range keys {
+		buf.WriteString(key.String())
+		buf.WriteByte('\n')
+	}
+	path := knownHostsPath()
+	_ = os.MkdirAll(filepath.Dir(path), 0700)
+	return os.WriteFile(path, buf.Bytes(), 0600)
+}
+
+// addHostKeys adds the given keys to the known_hosts file, replacing any existing keys of the same type for the same host.
+func addHostKeys(newKeys ...HostKey) error {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	keys, otherLines, err := readKnownHosts()
+	if err != nil {
+		return err
+	}
+	changed := false
+	for _, newKey := range newKeys {
+		found := false
+		for i, key := range keys {
+			if key.Host == newKey.Host && key.Type == newKey.Type {
+				found = true
+				if key.Key != newKey.Key {
+					log.Warnfln("Replacing %s host key of %s", key.Type, key.Host)
+					keys[i].Key = newKey.Key
+					changed = true
+				}
+			}
+		}
+		if !found {
+			keys = append(keys, newKey)
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return writeKnownHosts(keys, otherLines)
+}
+
+func parsePinnedHostKey(host, key string) (HostKey, error) {
+	fields := strings.Fields(key)
+	if len(fields) < 2 {
+		return HostKey{}, fmt.Errorf("invalid pinned host key for %s: expected \"<type> <base64 key>\"", host)
+	}
+	return HostKey{Host: host, Type: fields[0], Key: fields[1]}, nil
+}
+
+// initKnownHosts seeds the managed known_hosts file with the pinned host keys from the config.
+func initKnownHosts() error {
+	var keys []HostKey
+	for host, hostKeys := range config.SSH.HostKeys {
+		for _, key := range hostKeys {
+			parsed, err := parsePinnedHostKey(host, key)
+			if err != nil {
+				return err
+			}
+			keys = append(keys, parsed)
+		}
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+	return addHostKeys(keys...)
+}
+
+// scanHostKeys fetches the host keys offered by a host and stores them as pending approval.
+func scanHostKeys(host string) ([]HostKey, error) {
+	args := []string{"-q"}
+	hostname := host
+	if strings.HasPrefix(host, "[") {
+		if end := strings.Index(host, "]:"); end > 0 {
+			hostname = host[1:end]
+			args = append(args, "-p", host[end+2:])
+		}
+	}
+	output, err := exec.Command("ssh-keyscan", append(args, hostname)...).Output()
+	if err != nil {
+		return nil, fmt.Errorf("failed to scan host keys of %s: %w", host, err)
+	}
+	var keys []HostKey
+	for _, line := range strings.Split(string(output), "\n") {
+		fields := strings.Fields(line)
+		if len(fields) < 3 || strings.HasPrefix(fields[0], "#") {
+			continue
+		}
+		keys = append(keys, HostKey{Host: host, Type: fields[1], Key: fields[2]})
+	}
+	knownHostsLock.Lock()
+	pendingHostKeys[host] = keys
+	knownHostsLock.Unlock()
+	return keys, nil
+}
+
+func getPendingHostKeys() map[string][]HostKey {
+	knownHostsLock.Lock()
+	defer knownHostsLock.Unlock()
+	pending := make(map[string][]HostKey, len(pendingHostKeys))
+	for host, keys := range pendingHostKeys {
+		pending[host] = keys
+	}
+	return pending
+}
+
+// approvePendingHostKeys moves the pending keys of a host into the known_hosts file. If keyType is set,
+// only the key of that type is approved.
+func approvePendingHostKeys(host, keyType string) ([]HostKey, error) {
+	knownHostsLock.Lock()
+	pending := pendingHostKeys[host]
+	knownHostsLock.Unlock()
+	var approved []HostKey
+	for _, key := range pending {
+		if len(keyType) == 0 || key.Type == keyType {
+			approved = append(approved, key)
+		}
+	}
+	if len(approved) == 0 {
+		return nil, fmt.Errorf("no pending host keys for %s", host)
+	} else if err := addHostKeys(approved...); err != nil {
+		return nil, err
+	}
+	knownHostsLock.Lock()
+	delete(pendingHostKeys, host)
+	knownHostsLock.Unlock()
+	return approved, nil
+}
+
+var (
+	hostKeyChangedRegex = regexp.MustCompile(`Host key for (\S+) has changed`)
+	hostKeyUnknownRegex = regexp.MustCompile(`No \S+ host key is known for (\S+) and you have requested strict checking`)
+)
+
+// hostKeyErrorWriter passes script stderr through to the logger and remembers SSH host key verification failures.
+type hostKeyErrorWriter struct {
+	io.Writer
+	buf bytes.Buffer
+	err error
+}
+
+func (w *hostKeyErrorWriter) Write(data []byte) (int, error) {
+	w.buf.Write(data)
+	for {
+		line, err := w.buf.ReadString('\n')
+		if err != nil {
+			// Put the incomplete line back into the buffer
+			w.buf.Reset()
+			w.buf.WriteString(line)
+			break
+		}
+		w.checkLine(line)
+	}
+	return w.Writer.Write(data)
+}
+
+func (w *hostKeyErrorWriter) checkLine(line string) {
+	var host string
+	if w.err != nil {
+		return
+	} else if match := hostKeyChangedRegex.FindStringSubmatch(line); match != nil {
+		host = match[1]
+		w.err = fmt.Errorf("%w for %s: the host presented a different key than the one in %s", ErrHostKeyMismatch, host, knownHostsPath())
+	} else if match = hostKeyUnknownRegex.FindStringSubmatch(line); match != nil {
+		host = match[1]
+		w.err = fmt.Errorf("%w for %s: approve it through the admin API or pin it in the config", ErrHostKeyUnknown, host)
+	} else {
+		return
+	}
+	go func() {
+		if keys, err := scanHostKeys(host); err != nil {
+			log.Warnln(err)
+		} else {
+			log.Infofln("Found %d host keys for %s pending approval", len(keys), host)
+		}
+	}()
+}
+
+// Err returns the host key verification error found in the output, or nil if there weren't any.
+func (w *hostKeyErrorWriter) Err() error {
+	if w.err == nil && w.buf.Len() > 0 {
+		w.checkLine(w.buf.String())
+	}
+	return w.err
+}
@@ -0,0 +1,95 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/go-playground/webhooks/v6/gitlab"
+)
+
+// GitHub allows up to 65535 characters in the check run output text, leave some room for the surrounding markdown.
+const maxLogExcerptSize = 60000
+
+// How much of the end of the raw job log to fetch. Logs contain ANSI escape codes and section markers,
+// so more than maxLogExcerptSize is fetched to have enough left after cleaning them up.
+const maxRawLogTailSize = 4 * maxLogExcerptSize
+
+var ansiEscapeRegex = regexp.MustCompile(`\x1b\[[0-9;?]*[A-Za-z]`)
+var sectionMarkerRegex = regexp.MustCompile(`section_(?:start|end):\d+:[A-Za-z0-9_.\-]+(?:\[[^\]]*])?\r?`)
+
+// cleanJobTrace removes ANSI escape codes and GitLab's collapsible section markers from a job log,
+// and resolves carriage returns (e.g. progress bars) to the last written version of each line.
+func cleanJobTrace(trace string) string {
+	lines := strings.Split(strings.ReplaceAll(trace, "\r\n", "\n"), "\n")
+	cleaned := lines[:0]
+	for _, line := range lines {
+		line = ansiEscapeRegex.ReplaceAllString(line, "")
+		withoutMarkers := sectionMarkerRegex.ReplaceAllString(line, "")
+		if idx := strings.LastIndexByte(strings.TrimRight(withoutMarkers, "\r"), '\r'); idx >= 0 {
+			withoutMarkers = withoutMarkers[idx+1:]
+		}
+		withoutMarkers = strings.TrimRight(withoutMarkers, "\r")
+		// Drop lines that only contained a section marker
+		if len(withoutMarkers) == 0 && len(withoutMarkers) != len(line) {
+			continue
+		}
+		cleaned = append(cleaned, withoutMarkers)
+	}
+	return strings.TrimRight(strings.Join(cleaned, "\n"), "\n")
+}
+
+// tailLines returns at most maxLines lines and maxSize bytes from the end of the text.
+func tailLines(text string, maxLines, maxSize int) string {
+	lines := strings.Split(text, "\n")
+	if len(lines) > maxLines {
+		lines = lines[len(lines)-maxLines:]
+	}
+	text = strings.Join(lines, "\n")
+	if len(text) > maxSize {
+		text = text[len(text)-maxSize:]
+		// Don't start in the middle of a line, or a multi-byte character if the line is extremely long
+		if idx := strings.IndexByte(text, '\n'); idx >= 0 && idx < len(text)-1 {
+			text = text[idx+1:]
+		} else {
+			for len(text) > 0 && !utf8.RuneStart(text[0]) {
+				text = text[1:]
+			}
+		}
+	}
+	return text
+}
+
+// getJobLogExcerpt fetches the log of a job and returns the end of it as markdown for a check run output.
+func getJobLogExcerpt(repo *CIRepository, evt *gitlab.JobEventPayload) (string, error) {
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		return "", err
+	}
+	trace, err := gl.GetJobTraceTail(evt.ProjectID, evt.BuildID, maxRawLogTailSize)
+	if err != nil {
+		return "", fmt.Errorf("failed to get job log: %w", err)
+	}
+	excerpt := tailLines(cleanJobTrace(trace), repo.LogExcerptLines, maxLogExcerptSize)
+	if len(excerpt) == 0 {
+		return "", nil
+	}
+	return fmt.Sprintf("Last lines of the [job log](%s/-/jobs/%d):\n\n````\n%s\n````\n", evt.Repository.Homepage, evt.BuildID, excerpt), nil
+}
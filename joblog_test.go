@@ -0,0 +1,170 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCleanJobTrace(t *testing.T) {
+	tests := []struct {
+		name     string
+		trace    string
+		expected string
+	}{
+		{"plain", "line 1\nline 2\n", "line 1\nline 2"},
+		{"crlf", "line 1\r\nline 2\r\n", "line 1\nline 2"},
+		{"ansi colors", "\x1b[32;1mok\x1b[0;m done\n", "ok done"},
+		{"cursor codes", "\x1b[0K\x1b[?25lhidden cursor\n", "hidden cursor"},
+		{
+			"section markers on their own lines",
+			"section_start:1700000000:step_script\r\x1b[0K\nrunning tests\nsection_end:1700000001:step_script\r\x1b[0K\n",
+			"running tests",
+		},
+		{
+			"section marker with options before text",
+			"section_start:1700000000:build[collapsed=true]\r\x1b[0K\x1b[36;1mBuilding\x1b[0;m\n",
+			"Building",
+		},
+		{"progress bar", "downloading 10%\rdownloading 50%\rdownloading 100%\n", "downloading 100%"},
+		{"trailing carriage return", "done\r\n", "done"},
+		{"empty lines kept", "a\n\nb\n", "a\n\nb"},
+		{"empty", "", ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if cleaned := cleanJobTrace(test.trace); cleaned != test.expected {
+				t.Errorf("cleanJobTrace(%q) = %q, expected %q", test.trace, cleaned, test.expected)
+			}
+		})
+	}
+}
+
+func TestTailLines(t *testing.T) {
+	tests := []struct {
+		name     string
+		text     string
+		maxLines int
+		maxSize  int
+		expected string
+	}{
+		{"fits", "a\nb\nc", 5, 100, "a\nb\nc"},
+		{"line limit", "a\nb\nc\nd", 2, 100, "c\nd"},
+		{"size limit drops partial line", "first line\nsecond\nthird", 10, 9, "third"},
+		{"size limit at line start", "first line\nsecond\nthird", 10, 13, "second\nthird"},
+		{"size limit without newline", "abcdefghij", 10, 4, "ghij"},
+		{"size limit in multi-byte character", "ääää", 10, 3, "ä"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tail := tailLines(test.text, test.maxLines, test.maxSize)
+			if tail != test.expected {
+				t.Errorf("tailLines(%q, %d, %d) = %q, expected %q", test.text, test.maxLines, test.maxSize, tail, test.expected)
+			} else if !utf8.ValidString(tail) {
+				t.Errorf("tailLines(%q, %d, %d) returned invalid UTF-8", test.text, test.maxLines, test.maxSize)
+			}
+		})
+	}
+}
+
+func TestTailBuffer(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		writes   []string
+		expected string
+	}{
+		{"not full", 8, []string{"abc", "de"}, "abcde"},
+		{"exactly full", 4, []string{"ab", "cd"}, "abcd"},
+		{"wraps", 4, []string{"abc", "def"}, "cdef"},
+		{"single write larger than buffer", 4, []string{"abcdefgh"}, "efgh"},
+		{"many small writes", 3, []string{"a", "b", "c", "d", "e"}, "cde"},
+		{"exactly full after wrap", 4, []string{"abcdef", "gh"}, "efgh"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			tb := &tailBuffer{buf: make([]byte, test.size)}
+			for _, data := range test.writes {
+				if n, err := tb.Write([]byte(data)); err != nil || n != len(data) {
+					t.Fatalf("Write(%q) = %d, %v", data, n, err)
+				}
+			}
+			if out := string(tb.Bytes()); out != test.expected {
+				t.Errorf("buffer contains %q, expected %q", out, test.expected)
+			}
+		})
+	}
+}
+
+func TestGetJobTraceTail(t *testing.T) {
+	const trace = "line 1\nline 2\nline 3\nline 4\n"
+	tests := []struct {
+		name        string
+		honourRange bool
+		emptyLog    bool
+		maxSize     int
+		expected    string
+	}{
+		{"range cut mid-line", true, false, 10, "line 4\n"},
+		{"range covers whole log", true, false, 100, trace},
+		{"range ignored", false, false, 10, "line 4\n"},
+		{"range ignored, log fits", false, false, 100, trace},
+		{"empty log", true, true, 10, ""},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != "/api/v4/projects/1/jobs/2/trace" {
+					w.WriteHeader(http.StatusNotFound)
+					return
+				} else if r.Header.Get("PRIVATE-TOKEN") != "secret" {
+					w.WriteHeader(http.StatusUnauthorized)
+					return
+				}
+				if test.emptyLog {
+					w.WriteHeader(http.StatusRequestedRangeNotSatisfiable)
+					return
+				} else if !test.honourRange {
+					_, _ = w.Write([]byte(trace))
+					return
+				}
+				size, _ := strconv.Atoi(strings.TrimPrefix(r.Header.Get("Range"), "bytes=-"))
+				start := len(trace) - size
+				if start < 0 {
+					start = 0
+				}
+				w.Header().Set("Content-Range", fmt.Sprintf("bytes %d-%d/%d", start, len(trace)-1, len(trace)))
+				w.WriteHeader(http.StatusPartialContent)
+				_, _ = w.Write([]byte(trace[start:]))
+			}))
+			defer srv.Close()
+			gl := &GitLabClient{BaseURL: srv.URL, Token: "secret"}
+			tail, err := gl.GetJobTraceTail(1, 2, test.maxSize)
+			if err != nil {
+				t.Fatalf("GetJobTraceTail failed: %v", err)
+			} else if tail != test.expected {
+				t.Errorf("GetJobTraceTail returned %q, expected %q", tail, test.expected)
+			}
+		})
+	}
+}
@@ -0,0 +1,98 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+const defaultJobNameTemplate = "{name}"
+
+func (rule *JobRule) isEmpty() bool {
+	return len(rule.Name) == 0 && len(rule.Stage) == 0 && len(rule.Regex) == 0
+}
+
+func (rule *JobRule) compile() (err error) {
+	if rule.isEmpty() {
+		return errors.New("rule must have a name, stage or regex")
+	} else if len(rule.Regex) > 0 {
+		if rule.regex, err = regexp.Compile(rule.Regex); err != nil {
+			return fmt.Errorf("invalid regex: %w", err)
+		}
+	}
+	return nil
+}
+
+func compileJobRuleList(field string, rules []JobRule) error {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			return fmt.Errorf("%s[%d]: %w", field, i, err)
+		}
+	}
+	return nil
+}
+
+// compile checks the rules and compiles their regexes. It must be called before the rules are used,
+// i.e. whenever a CI repository is loaded or stored.
+func (rules *JobRules) compile() error {
+	if err := compileJobRuleList("include", rules.Include); err != nil {
+		return err
+	}
+	return compileJobRuleList("exclude", rules.Exclude)
+}
+
+func (rule *JobRule) matches(name, stage string) bool {
+	if len(rule.Name) > 0 && rule.Name != name {
+		return false
+	} else if len(rule.Stage) > 0 && rule.Stage != stage {
+		return false
+	} else if len(rule.Regex) > 0 {
+		// Rules whose regex wasn't compiled never match, rather than mirroring jobs that were meant to be filtered
+		return rule.regex != nil && rule.regex.MatchString(name)
+	}
+	return true
+}
+
+func matchesAnyJobRule(rules []JobRule, name, stage string) bool {
+	for i := range rules {
+		if rules[i].matches(name, stage) {
+			return true
+		}
+	}
+	return false
+}
+
+// shouldMirror checks whether a job with the given name and stage should get a check run.
+func (rules *JobRules) shouldMirror(name, stage string) bool {
+	if len(rules.Include) > 0 && !matchesAnyJobRule(rules.Include, name, stage) {
+		return false
+	}
+	return !matchesAnyJobRule(rules.Exclude, name, stage)
+}
+
+// checkRunName returns the check run name for a job. The same name must be used when creating and updating
+// check runs, as check runs are also looked up by name.
+func (rules *JobRules) checkRunName(name, stage string) string {
+	template := rules.NameTemplate
+	if len(template) == 0 {
+		template = defaultJobNameTemplate
+	}
+	return strings.NewReplacer("{name}", name, "{stage}", stage).Replace(template)
+}
@@ -0,0 +1,106 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import "testing"
+
+func TestJobRulesCompile(t *testing.T) {
+	tests := []struct {
+		name    string
+		rules   JobRules
+		wantErr bool
+	}{
+		{"no rules", JobRules{}, false},
+		{"valid rules", JobRules{Include: []JobRule{{Stage: "test"}, {Regex: "^build"}}, Exclude: []JobRule{{Name: "lint"}}}, false},
+		{"invalid include regex", JobRules{Include: []JobRule{{Regex: "("}}}, true},
+		{"invalid exclude regex", JobRules{Exclude: []JobRule{{Name: "a"}, {Regex: "[z-a]"}}}, true},
+		{"empty rule", JobRules{Include: []JobRule{{}}}, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			if err := test.rules.compile(); (err != nil) != test.wantErr {
+				t.Errorf("compile returned %v, expected error: %t", err, test.wantErr)
+			}
+		})
+	}
+}
+
+func TestJobRulesShouldMirror(t *testing.T) {
+	rules := JobRules{
+		Include: []JobRule{{Stage: "test"}, {Regex: "^build"}, {Name: "deploy", Stage: "release"}},
+		Exclude: []JobRule{{Name: "test-flaky"}, {Stage: "test", Regex: "-slow$"}},
+	}
+	if err := rules.compile(); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name, stage string
+		expected    bool
+	}{
+		{"unit", "test", true},
+		{"build-amd64", "build", true},
+		{"rebuild", "build", false},
+		{"deploy", "release", true},
+		{"deploy", "test", true},
+		{"deploy", "staging", false},
+		{"test-flaky", "test", false},
+		{"integration-slow", "test", false},
+		{"build-slow", "build", true},
+		{"lint", "lint", false},
+	}
+	for _, test := range tests {
+		if result := rules.shouldMirror(test.name, test.stage); result != test.expected {
+			t.Errorf("shouldMirror(%q, %q) = %t, expected %t", test.name, test.stage, result, test.expected)
+		}
+	}
+}
+
+func TestJobRulesWithoutIncludeMirrorEverything(t *testing.T) {
+	rules := JobRules{Exclude: []JobRule{{Regex: "^internal-"}}}
+	if err := rules.compile(); err != nil {
+		t.Fatal(err)
+	}
+	if !rules.shouldMirror("test", "test") {
+		t.Error("job not matching any exclude rule wasn't mirrored")
+	} else if rules.shouldMirror("internal-cache", "prepare") {
+		t.Error("job matching an exclude rule was mirrored")
+	}
+}
+
+func TestJobRuleUncompiledRegexNeverMatches(t *testing.T) {
+	rule := JobRule{Regex: ".*"}
+	if rule.matches("anything", "test") {
+		t.Error("rule with an uncompiled regex matched")
+	}
+}
+
+func TestJobRulesCheckRunName(t *testing.T) {
+	tests := []struct {
+		template, name, stage, expected string
+	}{
+		{"", "unit", "test", "unit"},
+		{"{stage} / {name}", "unit", "test", "test / unit"},
+		{"GitLab: {name}", "unit", "test", "GitLab: unit"},
+		{"{name} {name}", "{stage}", "test", "{stage} {stage}"},
+	}
+	for _, test := range tests {
+		rules := JobRules{NameTemplate: test.template}
+		if name := rules.checkRunName(test.name, test.stage); name != test.expected {
+			t.Errorf("checkRunName(%q, %q) with template %q = %q, expected %q", test.name, test.stage, test.template, name, test.expected)
+		}
+	}
+}
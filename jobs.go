@@ -0,0 +1,134 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os/exec"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+)
+
+var ErrJobCanceled = errors.New("job was canceled")
+
+type RunningJob struct {
+	Repository string     `json:"repository"`
+	StartedAt  time.Time  `json:"started_at"`
+	Deadline   *time.Time `json:"deadline,omitempty"`
+
+	cancel context.CancelFunc
+}
+
+var runningJobs = make(map[string]*RunningJob)
+var runningJobsLock sync.Mutex
+
+// startJob registers a running mirror job for the given repository. The returned context is canceled when the
+// timeout expires or the job is canceled through the admin API. The returned function must be called when the job is done.
+func startJob(name string, timeout time.Duration) (context.Context, func()) {
+	job := &RunningJob{
+		Repository: name,
+		StartedAt:  time.Now(),
+	}
+	var ctx context.Context
+	if timeout > 0 {
+		ctx, job.cancel = context.WithTimeout(context.Background(), timeout)
+		deadline := job.StartedAt.Add(timeout)
+		job.Deadline = &deadline
+	} else {
+		ctx, job.cancel = context.WithCancel(context.Background())
+	}
+	runningJobsLock.Lock()
+	runningJobs[name] = job
+	runningJobsLock.Unlock()
+	return ctx, func() {
+		runningJobsLock.Lock()
+		if runningJobs[name] == job {
+			delete(runningJobs, name)
+		}
+		runningJobsLock.Unlock()
+		job.cancel()
+	}
+}
+
+func cancelJob(name string) bool {
+	runningJobsLock.Lock()
+	job, ok := runningJobs[name]
+	runningJobsLock.Unlock()
+	if ok {
+		job.cancel()
+	}
+	return ok
+}
+
+func listJobs() []*RunningJob {
+	runningJobsLock.Lock()
+	defer runningJobsLock.Unlock()
+	jobs := make([]*RunningJob, 0, len(runningJobs))
+	for _, job := range runningJobs {
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+func (repo *Repository) getTimeout() time.Duration {
+	if repo.Timeout > 0 {
+		return time.Duration(repo.Timeout) * time.Second
+	}
+	return time.Duration(config.Shell.Timeout) * time.Second
+}
+
+// scriptPrefix returns shell commands that apply the configured resource limits to the script process.
+func (limits *ResourceLimits) scriptPrefix() string {
+	var buf strings.Builder
+	if limits.CPUTime > 0 {
+		_, _ = fmt.Fprintf(&buf, "ulimit -t %d\n", limits.CPUTime)
+	}
+	if limits.Memory > 0 {
+		_, _ = fmt.Fprintf(&buf, "ulimit -v %d\n", limits.Memory*1024)
+	}
+	return buf.String()
+}
+
+// waitProcessGroup waits for a command started with Setpgid to exit. If the context is done before
+// the command exits, the whole process group is killed.
+func waitProcessGroup(ctx context.Context, cmd *exec.Cmd, niceness int) error {
+	pgid := cmd.Process.Pid
+	if niceness != 0 {
+		_ = syscall.Setpriority(syscall.PRIO_PGRP, pgid, niceness)
+	}
+
+	done := make(chan struct{})
+	go func() {
+		select {
+		case <-ctx.Done():
+			_ = syscall.Kill(-pgid, syscall.SIGKILL)
+		case <-done:
+		}
+	}()
+	err := cmd.Wait()
+	close(done)
+	if ctxErr := ctx.Err(); errors.Is(ctxErr, context.DeadlineExceeded) {
+		return fmt.Errorf("timed out: %w", ctxErr)
+	} else if ctxErr != nil {
+		return ErrJobCanceled
+	}
+	return err
+}
@@ -0,0 +1,54 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"io/fs"
+	"path/filepath"
+)
+
+type LFSStats struct {
+	// Path to the LFS object cache of the repository.
+	Path string `json:"path"`
+	// Number of LFS objects in the cache.
+	Objects int `json:"objects"`
+	// Total size of the cached objects in bytes.
+	Size int64 `json:"size"`
+}
+
+func lfsStoragePath(owner, name string) (string, error) {
+	return filepath.Abs(filepath.Join(config.DataDir, "lfs", owner, name))
+}
+
+func getLFSStats(path string) (*LFSStats, error) {
+	stats := &LFSStats{Path: path}
+	err := filepath.WalkDir(filepath.Join(path, "objects"), func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			return err
+		} else if d.IsDir() {
+			return nil
+		}
+		info, err := d.Info()
+		if err != nil {
+			return err
+		}
+		stats.Objects++
+		stats.Size += info.Size()
+		return nil
+	})
+	return stats, err
+}
@@ -17,13 +17,18 @@
 package main
 
 import (
+	"bufio"
+	"errors"
 	"fmt"
+	"io"
 	"net/http"
 	"os"
+	"strings"
 	"sync"
+	"time"
 
 	"github.com/go-playground/webhooks/v6/github"
-	"gopkg.in/yaml.v2"
+	"gopkg.in/yaml.v3"
 
 	"maunium.net/go/mauflag"
 	log "maunium.net/go/maulogger/v2"
@@ -31,51 +36,102 @@ import (
 
 var configPath = mauflag.MakeFull("c", "config", "Path to config file", "config.yaml").String()
 var debugLogs = mauflag.MakeFull("d", "debug", "Print debug logs to stdout", "false").Bool()
+var masterKeyPath = mauflag.MakeFull("k", "master-key", "Path to the master key file for encrypted secrets. Defaults to the MAUMIRROR_MASTER_KEY environment variable", "").String()
+var encryptSecret = mauflag.MakeFull("e", "encrypt-secret", "Encrypt a secret read from stdin with the master key and print it", "false").Bool()
 var wantHelp, _ = mauflag.MakeHelpFlag()
 
+var adminHandlers = map[string]http.HandlerFunc{
+	"create":           createMirror,
+	"repos":            listMirrors,
+	"repo":             getOrDeleteMirror,
+	"sync":             syncMirror,
+	"ci/create":        createCIMirror,
+	"ci/reconcile":     reconcileCIMirrors,
+	"jobs":             listRunningJobs,
+	"jobs/cancel":      cancelRunningJob,
+	"hostkeys":         listHostKeys,
+	"hostkeys/approve": approveHostKeys,
+	"runs":             listRuns,
+	"deliveries":       listDeliveries,
+	"metrics":          getMetrics,
+}
+
 var config Config
 var lock = NewPartitionLocker(&sync.Mutex{})
 var ghHook, _ = github.New()
 
 func main() {
+	mauflag.SetHelpTitles("maumirror - A GitHub repo mirroring system using webhooks.", "maumirror [-hde] [-c <path>] [-k <path>] [validate | repo | sync | ci]")
 	if err := mauflag.Parse(); err != nil {
 		mauflag.PrintHelp()
 		os.Exit(1)
 	} else if *wantHelp {
 		mauflag.PrintHelp()
 		os.Exit(0)
-	} else if configData, err := os.ReadFile(*configPath); err != nil {
-		log.Fatalln("Failed to read config:", err)
-		os.Exit(10)
-	} else if err := yaml.Unmarshal(configData, &config); err != nil {
-		log.Fatalln("Failed to parse config:", err)
-		os.Exit(11)
+	} else if err = loadMasterKey(*masterKeyPath); err != nil {
+		log.Fatalln("Failed to load master key:", err)
+		os.Exit(9)
+	} else if *encryptSecret {
+		printEncryptedSecret()
+		return
 	}
 	if *debugLogs {
 		log.DefaultLogger.PrintLevel = log.LevelDebug.Severity
 	}
 
-	for name, repo := range config.Repositories {
-		repo.Name = name
-		repo.Log = log.Sub(name)
+	switch mauflag.Arg(0) {
+	case "":
+	case "validate":
+		os.Exit(validateCommand())
+	case "repo", "sync", "ci":
+		os.Exit(cliCommand(mauflag.Args()))
+	default:
+		mauflag.PrintHelp()
+		os.Exit(1)
 	}
 
-	for _, repo := range config.CIRepositories {
-		repo.checkSuiteIDs = make(map[string]int64)
-		repo.checkRunIDs = make(map[int64]int64)
-		repo.plock = NewPartitionLocker(&sync.Mutex{})
+	if err, code := loadConfig(); err != nil {
+		log.Fatalln(err)
+		os.Exit(code)
+	} else if err, code = initStore(); err != nil {
+		log.Fatalln(err)
+		os.Exit(code)
+	} else if err = initKnownHosts(); err != nil {
+		log.Fatalln("Failed to initialize known_hosts:", err)
+		os.Exit(12)
 	}
 
+	initCICaches()
+	go pruneCIMappingsLoop()
+
 	root := http.NewServeMux()
 	root.HandleFunc(config.Server.WebhookEndpoint, handleWebhook)
-	if len(config.GitHubApp.PrivateKey) > 0 && len(config.Server.CIWebhookEndpoint) > 0 {
+	if len(config.Server.CIWebhookEndpoint) > 0 {
+		root.HandleFunc(config.Server.CIWebhookEndpoint, handleCIWebhook)
+	}
+	if len(config.Server.CIStatusEndpoint) > 0 {
+		root.HandleFunc(config.Server.CIStatusEndpoint, handleCIStatusRequest)
+	}
+	if len(config.Server.GitHubCIWebhookEndpoint) > 0 {
+		root.HandleFunc(config.Server.GitHubCIWebhookEndpoint, handleGitHubCIWebhook)
+	}
+	if len(config.GitHubApp.PrivateKey.Value) > 0 && len(config.Server.CIWebhookEndpoint) > 0 {
 		log.Debugfln("Initializing GitHub app client")
 		initGHClient()
-		root.HandleFunc(config.Server.CIWebhookEndpoint, handleCIWebhook)
+		if len(config.Server.AppWebhookEndpoint) > 0 && len(config.GitHubApp.WebhookSecret.Value) == 0 {
+			log.Warnln("GitHub app webhook endpoint is set, but the webhook secret is not. App webhooks will not be accepted.")
+		} else if len(config.Server.AppWebhookEndpoint) > 0 {
+			root.HandleFunc(config.Server.AppWebhookEndpoint, handleAppWebhook)
+		}
+		if config.CIReconcile.OnStartup {
+			go reconcileCIRepositories(time.Now().Add(-reconcileWindow()), 0)
+		}
 	}
 	if len(config.Server.AdminEndpoint) > 0 {
 		log.Debugfln("Admin API is enabled")
-		root.HandleFunc(fmt.Sprintf("%s/create", config.Server.AdminEndpoint), createMirror)
+		for path, handler := range adminHandlers {
+			root.HandleFunc(fmt.Sprintf("%s/%s", config.Server.AdminEndpoint, path), handler)
+		}
 	}
 
 	log.Infoln("Listening at", config.Server.Address)
@@ -85,11 +141,33 @@ func main() {
 	}
 }
 
-func saveConfig() {
-	if data, err := yaml.Marshal(&config); err != nil {
-		log.Errorln("Failed to marshal config:", err)
-		return
-	} else if err := os.WriteFile(*configPath, data, 0600); err != nil {
-		log.Errorln("Failed to write config:", err)
+func loadConfig() (err error, code int) {
+	var configData []byte
+	if configData, err = os.ReadFile(*configPath); err != nil {
+		return fmt.Errorf("failed to read config: %w", err), 10
+	} else if err = yaml.Unmarshal(configData, &config); err != nil {
+		return fmt.Errorf("failed to parse config: %w", err), 11
+	}
+
+	if config.Repositories == nil {
+		config.Repositories = make(map[string]*Repository)
+	}
+	if config.CIRepositories == nil {
+		config.CIRepositories = make(map[int64]*CIRepository)
+	}
+	return nil, 0
+}
+
+func printEncryptedSecret() {
+	value, err := bufio.NewReader(os.Stdin).ReadString('\n')
+	if err != nil && !errors.Is(err, io.EOF) {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to read secret from stdin:", err)
+		os.Exit(1)
+	}
+	encrypted, err := EncryptSecret(strings.TrimRight(value, "\r\n"))
+	if err != nil {
+		_, _ = fmt.Fprintln(os.Stderr, "Failed to encrypt secret:", err)
+		os.Exit(1)
 	}
+	fmt.Println(encrypted)
 }
@@ -0,0 +1,117 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// JobOutputTemplateData is passed to the output templates of job check runs.
+// All fields of the GitLab job event are available directly, e.g. {{.BuildName}} or {{.Runner.Description}}.
+type JobOutputTemplateData struct {
+	*JobEvent
+	// Check run name and link to the job.
+	Name string
+	URL  string
+	// Formatted job duration and time spent waiting for a runner, empty if not known.
+	Duration       string
+	QueuedDuration string
+	// The default output, so templates can extend it instead of replacing it.
+	Title   string
+	Summary string
+	Text    string
+}
+
+func (tpls *JobOutputTemplates) isEmpty() bool {
+	return len(tpls.Title) == 0 && len(tpls.Summary) == 0 && len(tpls.Text) == 0
+}
+
+// compileOutputTemplate parses an output template and executes it with an empty job event to catch unknown fields.
+// The environment is left nil like in jobs that don't deploy, so templates must use {{with .Environment}} to access it.
+func compileOutputTemplate(name, tpl string) (*template.Template, error) {
+	if len(tpl) == 0 {
+		return nil, nil
+	}
+	parsed, err := template.New(name).Parse(tpl)
+	if err != nil {
+		return nil, fmt.Errorf("failed to parse %s template: %w", name, err)
+	} else if _, err = executeOutputTemplate(parsed, &JobOutputTemplateData{JobEvent: &JobEvent{}}); err != nil {
+		return nil, err
+	}
+	return parsed, nil
+}
+
+// compile parses the templates. It must be called before the templates are used,
+// i.e. whenever a CI repository is loaded or stored.
+func (tpls *JobOutputTemplates) compile() (err error) {
+	if tpls.title, err = compileOutputTemplate("title", tpls.Title); err != nil {
+		return err
+	} else if tpls.summary, err = compileOutputTemplate("summary", tpls.Summary); err != nil {
+		return err
+	}
+	tpls.text, err = compileOutputTemplate("text", tpls.Text)
+	return err
+}
+
+func executeOutputTemplate(tpl *template.Template, data *JobOutputTemplateData) (string, error) {
+	var buf strings.Builder
+	if err := tpl.Execute(&buf, data); err != nil {
+		return "", fmt.Errorf("failed to execute %s template: %w", tpl.Name(), err)
+	}
+	return strings.TrimSpace(buf.String()), nil
+}
+
+// applyOutputTemplates replaces the default check run output of a job with the output templates of the repository.
+// If a template fails, the default output is kept for that field.
+func applyOutputTemplates(repo *CIRepository, evt *JobEvent, opts *github.CreateCheckRunOptions) {
+	if repo.Output.isEmpty() {
+		return
+	}
+	data := &JobOutputTemplateData{
+		JobEvent:       evt,
+		Name:           opts.Name,
+		URL:            opts.GetDetailsURL(),
+		Duration:       formatDuration(time.Duration(evt.BuildDuration * float64(time.Second))),
+		QueuedDuration: formatDuration(time.Duration(evt.BuildQueuedDuration * float64(time.Second))),
+		Title:          opts.Output.GetTitle(),
+		Summary:        opts.Output.GetSummary(),
+		Text:           opts.Output.GetText(),
+	}
+	apply := func(tpl *template.Template, target **string, allowEmpty bool) {
+		if tpl == nil {
+			return
+		}
+		result, err := executeOutputTemplate(tpl, data)
+		if err != nil {
+			log.Warnfln("Failed to apply output template of job %d in %d: %v", evt.BuildID, evt.ProjectID, err)
+		} else if len(result) > 0 {
+			*target = &result
+		} else if allowEmpty {
+			*target = nil
+		}
+	}
+	// GitHub requires the title and summary to be set, so they're only replaced if the template output isn't empty
+	apply(repo.Output.title, &opts.Output.Title, false)
+	apply(repo.Output.summary, &opts.Output.Summary, false)
+	apply(repo.Output.text, &opts.Output.Text, true)
+}
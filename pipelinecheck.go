@@ -0,0 +1,188 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/gitlab"
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const defaultPipelineCheckName = "GitLab pipeline"
+
+var (
+	statusQueued = "queued"
+
+	conclusionSkipped        = "skipped"
+	conclusionActionRequired = "action_required"
+)
+
+var jobStatusEmojis = map[string]string{
+	"created":              "⚪",
+	"waiting_for_resource": "⏳",
+	"preparing":            "⏳",
+	"pending":              "⏳",
+	"running":              "🔵",
+	"success":              "✅",
+	"failed":               "❌",
+	"canceled":             "⛔",
+	"skipped":              "⏭️",
+	"manual":               "⚙️",
+	"scheduled":            "🕒",
+}
+
+func pipelineExternalID(pipelineID int64) string {
+	return fmt.Sprintf("pipeline-%d", pipelineID)
+}
+
+func (repo *CIRepository) pipelineCheckName() string {
+	if len(repo.PipelineCheckName) > 0 {
+		return repo.PipelineCheckName
+	}
+	return defaultPipelineCheckName
+}
+
+func formatDuration(duration time.Duration) string {
+	if duration <= 0 {
+		return ""
+	}
+	return duration.Round(time.Second).String()
+}
+
+func buildDuration(build *gitlab.Build) time.Duration {
+	if build.StartedAt.IsZero() {
+		return 0
+	} else if build.FinishedAt.IsZero() {
+		return time.Since(build.StartedAt.Time)
+	}
+	return build.FinishedAt.Sub(build.StartedAt.Time)
+}
+
+// formatPipelineJobTable makes a markdown table of the jobs in the pipeline, ordered by stage.
+func formatPipelineJobTable(evt *gitlab.PipelineEventPayload) string {
+	stageIndex := make(map[string]int, len(evt.ObjectAttributes.Stages))
+	for i, stage := range evt.ObjectAttributes.Stages {
+		stageIndex[stage] = i
+	}
+	builds := make([]gitlab.Build, len(evt.Builds))
+	copy(builds, evt.Builds)
+	sort.SliceStable(builds, func(i, j int) bool {
+		if builds[i].Stage != builds[j].Stage {
+			return stageIndex[builds[i].Stage] < stageIndex[builds[j].Stage]
+		}
+		return builds[i].Name < builds[j].Name
+	})
+
+	var table strings.Builder
+	table.WriteString("| Stage | Job | Status | Duration |\n")
+	table.WriteString("|-------|-----|--------|----------|\n")
+	for _, build := range builds {
+		_, _ = fmt.Fprintf(&table, "| %s | [%s](%s/-/jobs/%d) | %s %s | %s |\n",
+			build.Stage, build.Name, evt.Project.WebURL, build.ID,
+			jobStatusEmojis[build.Status], build.Status, formatDuration(buildDuration(&build)))
+	}
+	return table.String()
+}
+
+func makePipelineCheckRun(repo *CIRepository, evt *gitlab.PipelineEventPayload) github.CreateCheckRunOptions {
+	attrs := &evt.ObjectAttributes
+	detailsURL := fmt.Sprintf("%s/-/pipelines/%d", evt.Project.WebURL, attrs.ID)
+	externalID := pipelineExternalID(attrs.ID)
+	opts := github.CreateCheckRunOptions{
+		Name:       repo.pipelineCheckName(),
+		HeadSHA:    attrs.SHA,
+		DetailsURL: &detailsURL,
+		ExternalID: &externalID,
+		Output: &github.CheckRunOutput{
+			Text: stringPtr(formatPipelineJobTable(evt)),
+		},
+	}
+	var summary string
+	switch attrs.Status {
+	case "running":
+		opts.Status = &statusInProgress
+		opts.StartedAt = &github.Timestamp{Time: attrs.CreatedAt.Time}
+		opts.Output.Title = stringPtr("Pipeline running")
+		summary = "The pipeline is running."
+	case "success":
+		opts.Conclusion = &conclusionSuccess
+		opts.Output.Title = stringPtr("Pipeline passed")
+		summary = "The pipeline passed."
+	case "failed":
+		opts.Conclusion = &conclusionFailure
+		opts.Output.Title = stringPtr("Pipeline failed")
+		summary = "The pipeline failed."
+	case "canceled":
+		opts.Conclusion = &conclusionCancelled
+		opts.Output.Title = stringPtr("Pipeline canceled")
+		summary = "The pipeline was canceled."
+	case "skipped":
+		opts.Conclusion = &conclusionSkipped
+		opts.Output.Title = stringPtr("Pipeline skipped")
+		summary = "The pipeline was skipped."
+	case "manual":
+		opts.Conclusion = &conclusionActionRequired
+		opts.Output.Title = stringPtr("Pipeline blocked")
+		summary = "The pipeline is waiting for a manual job to be started."
+	default:
+		opts.Status = &statusQueued
+		opts.Output.Title = stringPtr("Pipeline pending")
+		summary = fmt.Sprintf("The pipeline is %s.", strings.ReplaceAll(attrs.Status, "_", " "))
+	}
+	if opts.Conclusion != nil {
+		opts.Status = &statusCompleted
+		completedAt := attrs.FinishedAt.Time
+		if completedAt.IsZero() {
+			completedAt = time.Now()
+		}
+		opts.CompletedAt = &github.Timestamp{Time: completedAt}
+		if attrs.Duration > 0 {
+			summary += fmt.Sprintf(" Duration: %s.", formatDuration(time.Duration(attrs.Duration)*time.Second))
+		}
+	}
+	opts.Output.Summary = stringPtr(fmt.Sprintf("[Pipeline #%d](%s) for `%s`: %s", attrs.ID, detailsURL, attrs.Ref, summary))
+	return opts
+}
+
+// updatePipelineCheckRun creates or updates the check run summarizing the whole pipeline.
+func updatePipelineCheckRun(repo *CIRepository, evt *gitlab.PipelineEventPayload) {
+	opts := makePipelineCheckRun(repo, evt)
+	if repo.usesCommitStatuses() {
+		postCommitStatus(repo, &opts)
+		return
+	}
+	cli := installationGHClient(repo.InstallationID)
+	attrs := evt.ObjectAttributes
+	queueCheckRunUpdate(&checkRunUpdate{
+		cli:    cli,
+		repo:   repo,
+		opts:   opts,
+		lookup: attrs.Status != "created" && attrs.Status != "pending",
+		callback: func(run *github.CheckRun, action string, err error) {
+			if err != nil {
+				log.Errorfln("Failed to %s pipeline check run for %s/%s#%d in %s/%s: %v", action, attrs.Ref, attrs.SHA, attrs.ID, repo.Owner, repo.Name, err)
+			} else {
+				log.Infofln("Successfully %sd pipeline check run for %s/%s#%d in %s/%s. Run ID: %d, status: %s %s", action, attrs.Ref, attrs.SHA, attrs.ID, repo.Owner, repo.Name, run.GetID(), run.GetStatus(), run.GetConclusion())
+			}
+		},
+	})
+}
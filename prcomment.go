@@ -0,0 +1,245 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/webhooks/v6/gitlab"
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// How long to wait for more events before updating the pull request comments of a pipeline.
+// Big pipelines send lots of job events in a short time, which would otherwise each edit the comment.
+const prCommentDebounceDelay = 5 * time.Second
+
+type prCommentUpdate struct {
+	// The newest pipeline webhook payload, used if the GitLab API isn't configured.
+	evt *gitlab.PipelineEventPayload
+}
+
+var prCommentUpdates = make(map[string]*prCommentUpdate)
+var prCommentUpdatesLock sync.Mutex
+
+// commentAuthors caches the GitHub login that managed comments are posted as, keyed by GitHub token or "app".
+var commentAuthors = make(map[string]string)
+var commentAuthorsLock sync.Mutex
+
+// prCommentMarker returns the hidden marker that identifies the managed summary comment of a GitLab project.
+// The project ID is included so that multiple projects mirroring to the same GitHub repo get separate comments.
+func (repo *CIRepository) prCommentMarker() string {
+	return fmt.Sprintf("<!-- maumirror-ci-summary:%d -->", repo.projectID)
+}
+
+// githubClient returns a GitHub API client for the repository in the checks or statuses mode.
+func (repo *CIRepository) githubClient() (*github.Client, error) {
+	switch {
+	case repo.Mode == CIModeStatuses:
+		return tokenGHClient(repo.GitHubToken.Value), nil
+	case repo.usesCommitStatuses():
+		return nil, fmt.Errorf("the GitHub API is not available in the %s mode", repo.Mode)
+	case appTransport == nil:
+		return nil, errors.New("the GitHub app is not configured")
+	default:
+		return installationGHClient(repo.InstallationID), nil
+	}
+}
+
+func formatPRComment(repo *CIRepository, evt *gitlab.PipelineEventPayload) string {
+	attrs := &evt.ObjectAttributes
+	return fmt.Sprintf("%s\n### %s [Pipeline #%d](%s/-/pipelines/%d) %s\n\nCommit %s on `%s`\n\n%s",
+		repo.prCommentMarker(), jobStatusEmojis[attrs.Status], attrs.ID, evt.Project.WebURL, attrs.ID,
+		strings.ReplaceAll(attrs.Status, "_", " "), attrs.SHA, attrs.Ref, formatPipelineJobTable(evt))
+}
+
+// commentAuthor returns the login of the GitHub user that the client of the repository acts as:
+// the bot user of the app in the checks mode, or the owner of the token in the statuses mode.
+func (repo *CIRepository) commentAuthor(cli *github.Client) (string, error) {
+	key := "app"
+	if repo.Mode == CIModeStatuses {
+		key = repo.GitHubToken.Value
+	}
+	commentAuthorsLock.Lock()
+	defer commentAuthorsLock.Unlock()
+	if login, ok := commentAuthors[key]; ok {
+		return login, nil
+	}
+	var login string
+	if repo.Mode == CIModeStatuses {
+		user, _, err := cli.Users.Get(context.Background(), "")
+		if err != nil {
+			return "", fmt.Errorf("failed to get token user: %w", err)
+		}
+		login = user.GetLogin()
+	} else {
+		app, _, err := appGHClient.Apps.Get(context.Background(), "")
+		if err != nil {
+			return "", fmt.Errorf("failed to get GitHub app info: %w", err)
+		}
+		login = app.GetSlug() + "[bot]"
+	}
+	commentAuthors[key] = login
+	return login, nil
+}
+
+// findPRComment finds the managed summary comment in a pull request by its marker and author.
+// Other users could post comments with the marker too, but those can't be edited.
+func findPRComment(cli *github.Client, repo *CIRepository, number int) (int64, error) {
+	author, err := repo.commentAuthor(cli)
+	if err != nil {
+		return 0, err
+	}
+	marker := repo.prCommentMarker()
+	opts := &github.IssueListCommentsOptions{ListOptions: github.ListOptions{PerPage: 100}}
+	for {
+		comments, resp, err := cli.Issues.ListComments(context.Background(), repo.Owner, repo.Name, number, opts)
+		if err != nil {
+			return 0, err
+		}
+		for _, comment := range comments {
+			if strings.HasPrefix(comment.GetBody(), marker) && strings.EqualFold(comment.GetUser().GetLogin(), author) {
+				return comment.GetID(), nil
+			}
+		}
+		if resp.NextPage == 0 {
+			return 0, nil
+		}
+		opts.Page = resp.NextPage
+	}
+}
+
+// upsertPRComment edits the managed summary comment in a pull request, or creates it if it doesn't exist yet.
+func upsertPRComment(cli *github.Client, repo *CIRepository, number int, body string) (action string, err error) {
+	key := fmt.Sprintf("%d/%s/%s#%d", repo.projectID, repo.Owner, repo.Name, number)
+	commentID, ok := prCommentCache.Get(key)
+	if !ok {
+		commentID, err = findPRComment(cli, repo, number)
+		if err != nil {
+			return "find", err
+		}
+	}
+	comment := &github.IssueComment{Body: &body}
+	if commentID != 0 {
+		_, resp, err := cli.Issues.EditComment(context.Background(), repo.Owner, repo.Name, commentID, comment)
+		if resp != nil && resp.StatusCode == http.StatusNotFound {
+			log.Debugfln("Managed comment %d in %s/%s#%d was deleted, creating a new one", commentID, repo.Owner, repo.Name, number)
+		} else if err != nil {
+			return "update", err
+		} else {
+			prCommentCache.Set(key, commentID)
+			return "update", nil
+		}
+	}
+	created, _, err := cli.Issues.CreateComment(context.Background(), repo.Owner, repo.Name, number, comment)
+	if err != nil {
+		return "create", err
+	}
+	prCommentCache.Set(key, created.GetID())
+	return "create", nil
+}
+
+// updatePRComments updates the pipeline summary comment in all open pull requests whose head is the pipeline commit.
+func updatePRComments(repo *CIRepository, evt *gitlab.PipelineEventPayload) {
+	sha := evt.ObjectAttributes.SHA
+	cli, err := repo.githubClient()
+	if err != nil {
+		log.Warnfln("Can't update pull request comments for %s in %s/%s: %v", sha, repo.Owner, repo.Name, err)
+		return
+	}
+	var prs []*github.PullRequest
+	err = retryOnRateLimit("find pull requests", func() (err error) {
+		prs, _, err = cli.PullRequests.ListPullRequestsWithCommit(context.Background(), repo.Owner, repo.Name, sha, nil)
+		return
+	})
+	if err != nil {
+		log.Errorfln("Failed to find pull requests for %s in %s/%s: %v", sha, repo.Owner, repo.Name, err)
+		return
+	}
+	body := formatPRComment(repo, evt)
+	for _, pr := range prs {
+		// Pipelines of older commits shouldn't overwrite the summary of the current head
+		if pr.GetState() != "open" || pr.GetHead().GetSHA() != sha {
+			continue
+		}
+		var action string
+		err = retryOnRateLimit("update pull request comment", func() (err error) {
+			action, err = upsertPRComment(cli, repo, pr.GetNumber(), body)
+			return
+		})
+		if err != nil {
+			log.Errorfln("Failed to %s pipeline summary comment in %s/%s#%d: %v", action, repo.Owner, repo.Name, pr.GetNumber(), err)
+		} else {
+			log.Debugfln("Successfully %sd pipeline summary comment in %s/%s#%d for pipeline %d", action, repo.Owner, repo.Name, pr.GetNumber(), evt.ObjectAttributes.ID)
+		}
+	}
+}
+
+// schedulePRCommentUpdate updates the pull request comments of a pipeline after prCommentDebounceDelay.
+// If the GitLab API is configured, the pipeline and its jobs are fetched when the update runs, so that job
+// events can update the comment too. Otherwise, the newest pipeline payload is used and evt must not be nil.
+func schedulePRCommentUpdate(repo *CIRepository, pipelineID int64, evt *gitlab.PipelineEventPayload) {
+	_, err := repo.gitlabClient()
+	if evt == nil && err != nil {
+		return
+	}
+	key := fmt.Sprintf("%d/%d", repo.projectID, pipelineID)
+	prCommentUpdatesLock.Lock()
+	defer prCommentUpdatesLock.Unlock()
+	upd, ok := prCommentUpdates[key]
+	if !ok {
+		upd = &prCommentUpdate{}
+		prCommentUpdates[key] = upd
+		time.AfterFunc(prCommentDebounceDelay, func() {
+			prCommentUpdatesLock.Lock()
+			delete(prCommentUpdates, key)
+			prCommentUpdatesLock.Unlock()
+			runPRCommentUpdate(repo, pipelineID, upd.evt)
+		})
+	}
+	if evt != nil {
+		upd.evt = evt
+	}
+}
+
+func runPRCommentUpdate(repo *CIRepository, pipelineID int64, evt *gitlab.PipelineEventPayload) {
+	// Updates of the same pipeline must not run concurrently, or an older one could overwrite a newer one
+	lockKey := fmt.Sprintf("pr-comment-%d", pipelineID)
+	repo.plock.Lock(lockKey)
+	defer repo.plock.Unlock(lockKey)
+	if gl, err := repo.gitlabClient(); err == nil {
+		pipeline, err := gl.GetPipeline(repo.projectID, pipelineID)
+		if err != nil {
+			log.Warnfln("Failed to get pipeline %d in %d for pull request comments: %v", pipelineID, repo.projectID, err)
+			return
+		}
+		jobs, err := gl.ListPipelineJobs(repo.projectID, pipelineID)
+		if err != nil {
+			log.Warnfln("Failed to get jobs of pipeline %d in %d for pull request comments: %v", pipelineID, repo.projectID, err)
+			return
+		}
+		fetched := pipeline.ToEvent(repo.projectID, jobs)
+		evt = &fetched
+	}
+	updatePRComments(repo, evt)
+}
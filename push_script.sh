@@ -4,10 +4,17 @@ if [[ ! -d $MM_REPOSITORY_OWNER ]]; then
 	mkdir $MM_REPOSITORY_OWNER
 fi
 cd $MM_REPOSITORY_OWNER
+# GIT_SSH_COMMAND is run through a shell, so paths in it must be quoted
+shell_quote() {
+	printf "'%s'" "$(printf '%s' "$1" | sed "s/'/'\\\\''/g")"
+}
+# Ignore ssh_config files so that they can't override the managed known_hosts file
+SSH_OPTIONS="-F /dev/null -o UserKnownHostsFile=$(shell_quote "$MM_KNOWN_HOSTS") -o StrictHostKeyChecking=$MM_STRICT_HOST_KEY_CHECKING"
 if [[ ! -z "$MM_SOURCE_KEY_PATH" ]]; then
-	export GIT_SSH_COMMAND="ssh -F /dev/null -o StrictHostKeyChecking=no -i $MM_SOURCE_KEY_PATH"
+	export GIT_SSH_COMMAND="ssh $SSH_OPTIONS -i $(shell_quote "$MM_SOURCE_KEY_PATH")"
 	SOURCE_URL="git@github.com:$MM_REPOSITORY_OWNER/$MM_REPOSITORY_NAME.git"
 else
+	export GIT_SSH_COMMAND="ssh $SSH_OPTIONS"
 	SOURCE_URL="https://github.com/$MM_REPOSITORY_OWNER/$MM_REPOSITORY_NAME.git"
 fi
 if [[ ! -z "$MM_SOURCE_URL_OVERRIDE" ]]; then
@@ -22,11 +29,20 @@ else
 	cd $MM_REPOSITORY_NAME.git
 	git fetch --quiet -p origin
 fi
+if [[ ! -z "$MM_LFS_STORAGE" ]]; then
+	git config lfs.storage "$MM_LFS_STORAGE"
+	echo "Fetching LFS objects from $(git remote get-url origin)"
+	git lfs fetch --all origin
+fi
 if [[ ! -z "$MM_TARGET_KEY_PATH" ]]; then
-	export GIT_SSH_COMMAND="ssh -F /dev/null -o StrictHostKeyChecking=no -i $MM_TARGET_KEY_PATH"
+	export GIT_SSH_COMMAND="ssh $SSH_OPTIONS -i $(shell_quote "$MM_TARGET_KEY_PATH")"
 else
-	unset GIT_SSH_COMMAND
+	export GIT_SSH_COMMAND="ssh $SSH_OPTIONS"
 fi
 git push --quiet --mirror
+if [[ ! -z "$MM_LFS_STORAGE" ]]; then
+	echo "Pushing LFS objects to $MM_TARGET_URL"
+	git lfs push --all "$MM_TARGET_URL"
+fi
 echo "Mirroring from $(git remote get-url origin) to $(git remote get-url --push origin) complete"
 exit 0
\ No newline at end of file
@@ -18,11 +18,17 @@ package main
 
 import (
 	"bytes"
+	"context"
 	_ "embed"
+	"errors"
+	"fmt"
 	"io"
 	"net/http"
 	"os/exec"
 	"runtime/debug"
+	"strings"
+	"syscall"
+	"time"
 
 	"github.com/go-playground/webhooks/v6/github"
 	log "maunium.net/go/maulogger/v2"
@@ -31,22 +37,98 @@ import (
 //go:embed push_script.sh
 var PushScript string
 
-func handlePushEvent(repo *Repository, evt github.PushPayload) int {
-	lock.Lock(evt.Repository.FullName)
-	defer lock.Unlock(evt.Repository.FullName)
+type MirrorResult struct {
+	StatusCode int `json:"-"`
+
+	Repository string    `json:"repository"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt time.Time `json:"finished_at"`
+	Error      string    `json:"error,omitempty"`
+	// Whether the job was canceled through the admin API.
+	Canceled bool `json:"canceled,omitempty"`
+
+	LFS  *LFSStats     `json:"lfs,omitempty"`
+	Wiki *MirrorResult `json:"wiki,omitempty"`
+}
+
+func (res *MirrorResult) fail(status int, err error) *MirrorResult {
+	res.StatusCode = status
+	res.Error = err.Error()
+	res.FinishedAt = time.Now()
+	return res
+}
+
+type mirrorJob struct {
+	Owner          string
+	Name           string
+	SourceURL      string
+	SourceOverride string
+	Target         string
+	LFS            bool
+}
+
+func (repo *Repository) splitName() (owner, name string) {
+	parts := strings.SplitN(repo.Name, "/", 2)
+	if len(parts) != 2 {
+		return "", repo.Name
+	}
+	return parts[0], parts[1]
+}
+
+func wikiURL(url string) string {
+	return strings.TrimSuffix(url, ".git") + ".wiki.git"
+}
+
+func (repo *Repository) wikiJob(code mirrorJob) mirrorJob {
+	job := mirrorJob{
+		Owner:     code.Owner,
+		Name:      code.Name + ".wiki",
+		SourceURL: wikiURL(code.SourceURL),
+		Target:    repo.WikiTarget,
+	}
+	if len(code.SourceOverride) > 0 {
+		job.SourceOverride = wikiURL(code.SourceOverride)
+	}
+	if len(job.Target) == 0 {
+		job.Target = wikiURL(code.Target)
+	}
+	return job
+}
+
+func runMirrorScript(ctx context.Context, repo *Repository, job mirrorJob) *MirrorResult {
+	res := &MirrorResult{
+		Repository: job.Owner + "/" + job.Name,
+		StartedAt:  time.Now(),
+	}
+
+	var lfsPath string
+	if job.LFS {
+		var err error
+		if lfsPath, err = lfsStoragePath(job.Owner, job.Name); err != nil {
+			repo.Log.Errorln("Failed to resolve LFS storage path:", err)
+			return res.fail(http.StatusInternalServerError, fmt.Errorf("failed to resolve LFS storage path: %w", err))
+		}
+	}
 
 	cmd := exec.Command(config.Shell.Command, config.Shell.Args...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
 	cmd.Dir = config.DataDir
 	cmd.Env = append(cmd.Env,
-		"MM_REPOSITORY_NAME="+evt.Repository.Name,
-		"MM_REPOSITORY_OWNER="+evt.Repository.Owner.Login,
-		"MM_SOURCE_URL="+evt.Repository.GitURL,
-		"MM_SOURCE_URL_OVERRIDE="+repo.Source,
+		"MM_REPOSITORY_NAME="+job.Name,
+		"MM_REPOSITORY_OWNER="+job.Owner,
+		"MM_SOURCE_URL="+job.SourceURL,
+		"MM_SOURCE_URL_OVERRIDE="+job.SourceOverride,
 		"MM_SOURCE_KEY_PATH="+repo.PullKey,
 
-		"MM_TARGET_URL="+repo.Target,
-		"MM_TARGET_KEY_PATH="+repo.PushKey)
-	cmd.Stderr = repo.Log.Writer(log.LevelError)
+		"MM_TARGET_URL="+job.Target,
+		"MM_TARGET_KEY_PATH="+repo.PushKey,
+
+		"MM_LFS_STORAGE="+lfsPath,
+
+		"MM_KNOWN_HOSTS="+knownHostsPath(),
+		"MM_STRICT_HOST_KEY_CHECKING="+strictHostKeyChecking())
+	hostKeyErrors := &hostKeyErrorWriter{Writer: repo.Log.Writer(log.LevelError)}
+	cmd.Stderr = hostKeyErrors
 	cmd.Stdout = repo.Log.Writer(log.LevelInfo)
 
 	script := PushScript
@@ -54,27 +136,102 @@ func handlePushEvent(repo *Repository, evt github.PushPayload) int {
 		repo.Log.Debugln("Using push handler script from", config.Shell.Scripts.Push.Path)
 		script = config.Shell.Scripts.Push.Data
 	}
+	script = config.Shell.Limits.scriptPrefix() + script
 
 	if stdin, err := cmd.StdinPipe(); err != nil {
 		repo.Log.Errorln("Failed to open stdin pipe for subprocess:", err)
-		return http.StatusInternalServerError
+		return res.fail(http.StatusInternalServerError, fmt.Errorf("failed to open stdin pipe: %w", err))
 	} else if _, err = stdin.Write([]byte(script)); err != nil {
 		repo.Log.Errorln("Failed to write script to stdin of subprocess:", err)
-		return http.StatusInternalServerError
+		return res.fail(http.StatusInternalServerError, fmt.Errorf("failed to write script to stdin: %w", err))
 	} else if err = cmd.Start(); err != nil {
 		repo.Log.Errorln("Failed to start command:", err)
-		return http.StatusInternalServerError
+		return res.fail(http.StatusInternalServerError, fmt.Errorf("failed to start command: %w", err))
 	} else if err = stdin.Close(); err != nil {
 		repo.Log.Warnln("Failed to close stdin:", err)
 	}
-	if err := cmd.Wait(); err != nil {
+	if err := waitProcessGroup(ctx, cmd, config.Shell.Limits.Niceness); errors.Is(err, context.DeadlineExceeded) {
+		repo.Log.Errorln("Mirror script timed out, killed process group")
+		return res.fail(http.StatusGatewayTimeout, fmt.Errorf("mirror script %w", err))
+	} else if errors.Is(err, ErrJobCanceled) {
+		repo.Log.Warnln("Mirror job was canceled, killed process group")
+		res.Canceled = true
+		return res.fail(http.StatusConflict, err)
+	} else if hostKeyErr := hostKeyErrors.Err(); hostKeyErr != nil {
+		repo.Log.Errorln("SSH host key verification failed:", hostKeyErr)
+		return res.fail(http.StatusBadGateway, hostKeyErr)
+	} else if err != nil {
 		repo.Log.Errorln("Error waiting for command:", err)
-		return http.StatusInternalServerError
+		return res.fail(http.StatusInternalServerError, fmt.Errorf("mirror script failed: %w", err))
+	}
+	if len(lfsPath) > 0 {
+		var err error
+		if res.LFS, err = getLFSStats(lfsPath); err != nil {
+			repo.Log.Warnln("Failed to collect LFS cache stats:", err)
+		} else {
+			repo.Log.Debugfln("LFS cache at %s contains %d objects (%d bytes)", res.LFS.Path, res.LFS.Objects, res.LFS.Size)
+		}
 	}
-	return http.StatusOK
+	res.StatusCode = http.StatusOK
+	res.FinishedAt = time.Now()
+	return res
+}
+
+// syncRepository mirrors the given repository (and its wiki if enabled). The source URL is only
+// passed to the mirror script for informational purposes.
+func syncRepository(repo *Repository, sourceURL string) *MirrorResult {
+	lock.Lock(repo.Name)
+	defer lock.Unlock(repo.Name)
+	ctx, done := startJob(repo.Name, repo.getTimeout())
+	defer done()
+
+	owner, name := repo.splitName()
+	job := mirrorJob{
+		Owner:          owner,
+		Name:           name,
+		SourceURL:      sourceURL,
+		SourceOverride: repo.Source,
+		Target:         repo.Target,
+		LFS:            repo.LFS,
+	}
+	res := runMirrorScript(ctx, repo, job)
+	if repo.MirrorWiki && ctx.Err() == nil {
+		res.Wiki = runMirrorScript(ctx, repo, repo.wikiJob(job))
+		if res.StatusCode == http.StatusOK {
+			res.StatusCode = res.Wiki.StatusCode
+		}
+	}
+	return res
+}
+
+func handlePushEvent(repo *Repository, evt github.PushPayload) *MirrorResult {
+	res := syncRepository(repo, evt.Repository.GitURL)
+	recordRun(repo, "push", res)
+	return res
+}
+
+func handleGollumEvent(repo *Repository, evt github.GollumPayload) *MirrorResult {
+	lock.Lock(repo.Name)
+	defer lock.Unlock(repo.Name)
+	ctx, done := startJob(repo.Name, repo.getTimeout())
+	defer done()
+
+	owner, name := repo.splitName()
+	res := runMirrorScript(ctx, repo, repo.wikiJob(mirrorJob{
+		Owner:          owner,
+		Name:           name,
+		SourceURL:      evt.Repository.GitURL,
+		SourceOverride: repo.Source,
+		Target:         repo.Target,
+	}))
+	recordRun(repo, "gollum", res)
+	return res
 }
 
 func handleWebhook(w http.ResponseWriter, r *http.Request) {
+	rec := newDeliveryRecorder(w, "github", r.Header.Get("X-GitHub-Delivery"), r.Header.Get("X-GitHub-Event"))
+	w = rec
+	defer rec.save()
 	defer func() {
 		err := recover()
 		if err != nil {
@@ -96,7 +253,7 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 	}
 	r.Body = io.NopCloser(bytes.NewBuffer(bodyBytes))
 
-	rawEvt, err := ghHook.Parse(r, github.PushEvent, github.PingEvent)
+	rawEvt, err := ghHook.Parse(r, github.PushEvent, github.GollumEvent, github.PingEvent)
 	if err != nil {
 		respondErr(w, r, err, http.StatusBadRequest)
 		return
@@ -106,16 +263,30 @@ func handleWebhook(w http.ResponseWriter, r *http.Request) {
 
 	switch evt := rawEvt.(type) {
 	case github.PingPayload:
+		rec.Repository = evt.Repository.FullName
 		if repo, err, code := checkSig(r, evt.Repository.FullName); err != nil {
 			respondErr(w, r, err, code)
 		} else {
 			repo.Log.Infoln("Received webhook ping from", readUserIP(r))
 		}
 	case github.PushPayload:
+		rec.Repository = evt.Repository.FullName
+		if repo, err, code := checkSig(r, evt.Repository.FullName); err != nil {
+			respondErr(w, r, err, code)
+		} else {
+			res := handlePushEvent(repo, evt)
+			respondJSON(w, res.StatusCode, res)
+		}
+	case github.GollumPayload:
+		rec.Repository = evt.Repository.FullName
 		if repo, err, code := checkSig(r, evt.Repository.FullName); err != nil {
 			respondErr(w, r, err, code)
+		} else if !repo.MirrorWiki {
+			repo.Log.Debugln("Ignoring wiki event as wiki mirroring is not enabled")
+			w.WriteHeader(http.StatusOK)
 		} else {
-			w.WriteHeader(handlePushEvent(repo, evt))
+			res := handleGollumEvent(repo, evt)
+			respondJSON(w, res.StatusCode, res)
 		}
 	}
 }
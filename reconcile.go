@@ -0,0 +1,186 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"sort"
+	"strconv"
+	"time"
+
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+const defaultReconcileWindow = 24 * time.Hour
+
+type ReconcileResult struct {
+	ProjectID  int64  `json:"project_id"`
+	Repository string `json:"repository"`
+	Pipelines  int    `json:"pipelines"`
+	Jobs       int    `json:"jobs"`
+	Updated    int    `json:"updated"`
+	Error      string `json:"error,omitempty"`
+}
+
+func reconcileWindow() time.Duration {
+	if config.CIReconcile.Window > 0 {
+		return time.Duration(config.CIReconcile.Window) * time.Second
+	}
+	return defaultReconcileWindow
+}
+
+func isFinishedJobStatus(status string) bool {
+	switch status {
+	case "success", "failed", "canceled", "skipped", "manual":
+		return true
+	default:
+		return false
+	}
+}
+
+func isFinishedPipelineStatus(status string) bool {
+	switch status {
+	case "success", "failed", "canceled", "skipped", "manual":
+		return true
+	default:
+		return false
+	}
+}
+
+// listCheckRunsByExternalID returns the newest check run for each external ID on the given commit.
+func listCheckRunsByExternalID(cli *github.Client, repo *CIRepository, sha string) (map[string]*github.CheckRun, error) {
+	runs := make(map[string]*github.CheckRun)
+	opts := &github.ListCheckRunsOptions{
+		Filter:      stringPtr("all"),
+		ListOptions: github.ListOptions{PerPage: 100},
+	}
+	for {
+		resp, httpResp, err := cli.Checks.ListCheckRunsForRef(context.Background(), repo.Owner, repo.Name, sha, opts)
+		if err != nil {
+			return runs, err
+		}
+		for _, run := range resp.CheckRuns {
+			existing, ok := runs[run.GetExternalID()]
+			if !ok || run.GetID() > existing.GetID() {
+				runs[run.GetExternalID()] = run
+			}
+		}
+		if httpResp.NextPage == 0 {
+			return runs, nil
+		}
+		opts.Page = httpResp.NextPage
+	}
+}
+
+// reconcileCIRepository fetches the pipelines updated after the given time from GitLab and
+// creates or updates any check runs that don't reflect the current state of their job.
+func reconcileCIRepository(repo *CIRepository, since time.Time) *ReconcileResult {
+	res := &ReconcileResult{
+		ProjectID:  repo.projectID,
+		Repository: fmt.Sprintf("%s/%s", repo.Owner, repo.Name),
+	}
+	if repo.usesCommitStatuses() {
+		res.Error = "reconciliation is only supported in the checks mode"
+		return res
+	}
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		res.Error = err.Error()
+		return res
+	}
+	pipelines, err := gl.ListPipelines(repo.projectID, since)
+	if err != nil {
+		res.Error = fmt.Sprintf("failed to list pipelines: %v", err)
+		return res
+	}
+	// Handle the oldest pipelines first, so that newer pipelines for the same commit win
+	sort.Slice(pipelines, func(i, j int) bool {
+		return pipelines[i].ID < pipelines[j].ID
+	})
+	cli := installationGHClient(repo.InstallationID)
+	for _, pipeline := range pipelines {
+		jobs, err := gl.ListPipelineJobs(repo.projectID, pipeline.ID)
+		if err != nil {
+			res.Error = fmt.Sprintf("failed to list jobs of pipeline %d: %v", pipeline.ID, err)
+			return res
+		}
+		runs, err := listCheckRunsByExternalID(cli, repo, pipeline.SHA)
+		if err != nil {
+			res.Error = fmt.Sprintf("failed to list check runs of %s: %v", pipeline.SHA, err)
+			return res
+		}
+		res.Pipelines++
+		for _, job := range jobs {
+			if !repo.Jobs.shouldMirror(job.Name, job.Stage) {
+				continue
+			}
+			res.Jobs++
+			externalID := strconv.FormatInt(job.ID, 10)
+			run, ok := runs[externalID]
+			if ok {
+				repo.setCheckRunID(externalID, run.GetID())
+				// Manual jobs are marked as completed on GitHub, but they may have been started since then
+				upToDate := run.GetStatus() == statusCompleted && (run.GetConclusion() != conclusionActionRequired || job.Status == "manual")
+				if upToDate || !isFinishedJobStatus(job.Status) {
+					continue
+				}
+			}
+			log.Debugfln("Reconciling job %d (%s) in %d: GitLab status is %s, check run exists: %t",
+				job.ID, job.Name, repo.projectID, job.Status, ok)
+			handleJobEvent(repo, job.ToEvent(repo.projectID))
+			res.Updated++
+		}
+		externalID := pipelineExternalID(pipeline.ID)
+		run, ok := runs[externalID]
+		if ok {
+			repo.setCheckRunID(externalID, run.GetID())
+			if run.GetStatus() == statusCompleted || !isFinishedPipelineStatus(pipeline.Status) {
+				continue
+			}
+		}
+		log.Debugfln("Reconciling pipeline %d in %d: GitLab status is %s, check run exists: %t", pipeline.ID, repo.projectID, pipeline.Status, ok)
+		evt := pipeline.ToEvent(repo.projectID, jobs)
+		repo.plock.Lock(pipeline.SHA)
+		updatePipelineCheckRun(repo, &evt)
+		repo.plock.Unlock(pipeline.SHA)
+	}
+	return res
+}
+
+// reconcileCIRepositories reconciles all checks mode CI repositories that have the GitLab API configured,
+// or only the given project if projectID is non-zero.
+func reconcileCIRepositories(since time.Time, projectID int64) []*ReconcileResult {
+	results := make([]*ReconcileResult, 0)
+	for id, repo := range getCIRepositories() {
+		if projectID != 0 && id != projectID {
+			continue
+		} else if _, err := repo.gitlabClient(); projectID == 0 && (errors.Is(err, ErrGitLabAPINotConfigured) || repo.usesCommitStatuses()) {
+			continue
+		}
+		res := reconcileCIRepository(repo, since)
+		if len(res.Error) > 0 {
+			log.Warnfln("Failed to reconcile CI status of %d to %s: %s", id, res.Repository, res.Error)
+		} else {
+			log.Infofln("Reconciled CI status of %d to %s: updated %d of %d jobs in %d pipelines", id, res.Repository, res.Updated, res.Jobs, res.Pipelines)
+		}
+		results = append(results, res)
+	}
+	return results
+}
@@ -0,0 +1,182 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+)
+
+const (
+	SecretPrefixEnv       = "env:"
+	SecretPrefixFile      = "file:"
+	SecretPrefixEncrypted = "enc:"
+)
+
+var ErrNoMasterKey = errors.New("encrypted secrets require a master key")
+
+var masterKey []byte
+
+// loadMasterKey loads the AES-256 key used for encrypted secrets, either from the given file or the
+// MAUMIRROR_MASTER_KEY environment variable. The key is 32 bytes encoded as standard base64.
+func loadMasterKey(path string) error {
+	var encoded string
+	if len(path) > 0 {
+		data, err := os.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("failed to read master key: %w", err)
+		}
+		encoded = string(data)
+	} else {
+		encoded = os.Getenv("MAUMIRROR_MASTER_KEY")
+	}
+	encoded = strings.TrimSpace(encoded)
+	if len(encoded) == 0 {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return fmt.Errorf("failed to decode master key: %w", err)
+	} else if len(key) != 32 {
+		return fmt.Errorf("master key must be 32 bytes, got %d", len(key))
+	}
+	masterKey = key
+	return nil
+}
+
+func masterCipher() (cipher.AEAD, error) {
+	if masterKey == nil {
+		return nil, ErrNoMasterKey
+	}
+	block, err := aes.NewCipher(masterKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// EncryptSecret encrypts a secret value with the master key and returns it as an "enc:" reference.
+func EncryptSecret(value string) (string, error) {
+	gcm, err := masterCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err = rand.Read(nonce); err != nil {
+		return "", err
+	}
+	return SecretPrefixEncrypted + base64.StdEncoding.EncodeToString(gcm.Seal(nonce, nonce, []byte(value), nil)), nil
+}
+
+func decryptSecret(encoded string) (string, error) {
+	gcm, err := masterCipher()
+	if err != nil {
+		return "", err
+	}
+	data, err := base64.StdEncoding.DecodeString(encoded)
+	if err != nil {
+		return "", err
+	} else if len(data) < gcm.NonceSize() {
+		return "", errors.New("ciphertext too short")
+	}
+	plaintext, err := gcm.Open(nil, data[:gcm.NonceSize()], data[gcm.NonceSize():], nil)
+	return string(plaintext), err
+}
+
+// Secret is a config value that can either be written in plaintext or as a reference to the actual value:
+// env:NAME reads an environment variable, file:/path reads a file and enc:base64 is decrypted with the master key.
+// The reference is preserved when the config is saved.
+type Secret struct {
+	Ref   string
+	Value string
+}
+
+func ParseSecret(raw string) (Secret, error) {
+	secret := Secret{Ref: raw}
+	switch {
+	case strings.HasPrefix(raw, SecretPrefixEnv):
+		name := strings.TrimPrefix(raw, SecretPrefixEnv)
+		var ok bool
+		if secret.Value, ok = os.LookupEnv(name); !ok {
+			return secret, fmt.Errorf("environment variable %s is not set", name)
+		}
+	case strings.HasPrefix(raw, SecretPrefixFile):
+		data, err := os.ReadFile(strings.TrimPrefix(raw, SecretPrefixFile))
+		if err != nil {
+			return secret, fmt.Errorf("failed to read secret file: %w", err)
+		}
+		secret.Value = strings.TrimRight(string(data), "\r\n")
+	case strings.HasPrefix(raw, SecretPrefixEncrypted):
+		var err error
+		if secret.Value, err = decryptSecret(strings.TrimPrefix(raw, SecretPrefixEncrypted)); err != nil {
+			return secret, fmt.Errorf("failed to decrypt secret: %w", err)
+		}
+	default:
+		secret = Secret{Value: raw}
+	}
+	return secret, nil
+}
+
+func (secret *Secret) UnmarshalYAML(unmarshal func(interface{}) error) error {
+	var raw string
+	if err := unmarshal(&raw); err != nil {
+		return err
+	}
+	parsed, err := ParseSecret(raw)
+	if err != nil {
+		return err
+	}
+	*secret = parsed
+	return nil
+}
+
+func (secret Secret) MarshalYAML() (interface{}, error) {
+	if len(secret.Ref) > 0 {
+		return secret.Ref, nil
+	}
+	return secret.Value, nil
+}
+
+// UnmarshalJSON reads a plaintext secret. References aren't resolved from JSON, as that would allow
+// admin API users to read arbitrary files and environment variables.
+func (secret *Secret) UnmarshalJSON(data []byte) error {
+	secret.Ref = ""
+	return json.Unmarshal(data, &secret.Value)
+}
+
+func (secret Secret) MarshalJSON() ([]byte, error) {
+	if len(secret.Ref) > 0 {
+		return json.Marshal(secret.Ref)
+	}
+	return json.Marshal(secret.Value)
+}
+
+// Redacted returns a copy of the secret that is safe to show to admin API users.
+// References are kept as-is, plaintext values are masked.
+func (secret Secret) Redacted() Secret {
+	if len(secret.Ref) == 0 && len(secret.Value) > 0 {
+		return Secret{Value: "********"}
+	}
+	return Secret{Ref: secret.Ref}
+}
@@ -0,0 +1,226 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gopkg.in/yaml.v3"
+)
+
+func setTestMasterKey(t *testing.T, key []byte) {
+	prev := masterKey
+	masterKey = key
+	t.Cleanup(func() { masterKey = prev })
+}
+
+func TestEncryptSecretRoundTrip(t *testing.T) {
+	setTestMasterKey(t, bytes.Repeat([]byte{0x42}, 32))
+	for _, value := range []string{"", "hunter2", "multi\nline\nsecret", "ünïcödé 🔑", strings.Repeat("x", 4096)} {
+		encrypted, err := EncryptSecret(value)
+		if err != nil {
+			t.Fatalf("EncryptSecret(%q) failed: %v", value, err)
+		} else if !strings.HasPrefix(encrypted, SecretPrefixEncrypted) {
+			t.Fatalf("EncryptSecret(%q) = %q, missing %q prefix", value, encrypted, SecretPrefixEncrypted)
+		}
+		parsed, err := ParseSecret(encrypted)
+		if err != nil {
+			t.Fatalf("ParseSecret(%q) failed: %v", encrypted, err)
+		} else if parsed.Value != value || parsed.Ref != encrypted {
+			t.Errorf("ParseSecret(%q) = %+v, expected value %q with the reference kept", encrypted, parsed, value)
+		}
+	}
+}
+
+func TestEncryptSecretUsesRandomNonce(t *testing.T) {
+	setTestMasterKey(t, bytes.Repeat([]byte{0x42}, 32))
+	first, err := EncryptSecret("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := EncryptSecret("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	} else if first == second {
+		t.Errorf("encrypting the same value twice produced the same ciphertext %q", first)
+	}
+}
+
+func TestDecryptSecretErrors(t *testing.T) {
+	key := bytes.Repeat([]byte{0x42}, 32)
+	setTestMasterKey(t, key)
+	encrypted, err := EncryptSecret("hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, _ := base64.StdEncoding.DecodeString(strings.TrimPrefix(encrypted, SecretPrefixEncrypted))
+	data[len(data)-1] ^= 0xff
+	tampered := SecretPrefixEncrypted + base64.StdEncoding.EncodeToString(data)
+
+	tests := []struct {
+		name string
+		key  []byte
+		raw  string
+	}{
+		{"wrong key", bytes.Repeat([]byte{0x24}, 32), encrypted},
+		{"tampered ciphertext", key, tampered},
+		{"too short", key, SecretPrefixEncrypted + base64.StdEncoding.EncodeToString([]byte("short"))},
+		{"invalid base64", key, SecretPrefixEncrypted + "not base64!"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestMasterKey(t, test.key)
+			if _, err := ParseSecret(test.raw); err == nil {
+				t.Errorf("ParseSecret(%q) succeeded, expected an error", test.raw)
+			}
+		})
+	}
+
+	t.Run("no master key", func(t *testing.T) {
+		setTestMasterKey(t, nil)
+		if _, err := ParseSecret(encrypted); !errors.Is(err, ErrNoMasterKey) {
+			t.Errorf("ParseSecret without a master key returned %v, expected %v", err, ErrNoMasterKey)
+		} else if _, err = EncryptSecret("hunter2"); !errors.Is(err, ErrNoMasterKey) {
+			t.Errorf("EncryptSecret without a master key returned %v, expected %v", err, ErrNoMasterKey)
+		}
+	})
+}
+
+func TestLoadMasterKey(t *testing.T) {
+	dir := t.TempDir()
+	writeKey := func(name, content string) string {
+		path := filepath.Join(dir, name)
+		if err := os.WriteFile(path, []byte(content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		return path
+	}
+	validKey := base64.StdEncoding.EncodeToString(bytes.Repeat([]byte{1}, 32))
+	tests := []struct {
+		name    string
+		path    string
+		env     string
+		wantKey bool
+		wantErr bool
+	}{
+		{"file with trailing newline", writeKey("valid", validKey+"\n"), "", true, false},
+		{"environment variable", "", validKey, true, false},
+		{"not set", "", "", false, false},
+		{"short key", writeKey("short", base64.StdEncoding.EncodeToString([]byte("too short"))), "", false, true},
+		{"invalid base64", writeKey("invalid", "not base64!"), "", false, true},
+		{"missing file", filepath.Join(dir, "missing"), "", false, true},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			setTestMasterKey(t, nil)
+			t.Setenv("MAUMIRROR_MASTER_KEY", test.env)
+			err := loadMasterKey(test.path)
+			if (err != nil) != test.wantErr {
+				t.Fatalf("loadMasterKey returned %v, expected error: %t", err, test.wantErr)
+			} else if (masterKey != nil) != test.wantKey {
+				t.Errorf("master key loaded: %t, expected %t", masterKey != nil, test.wantKey)
+			}
+		})
+	}
+}
+
+func TestParseSecretReferences(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "secret")
+	if err := os.WriteFile(path, []byte("from file\r\n\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	t.Setenv("MAUMIRROR_TEST_SECRET", "from env")
+	tests := []struct {
+		raw       string
+		wantValue string
+		wantRef   string
+		wantErr   bool
+	}{
+		{"plaintext", "plaintext", "", false},
+		{"", "", "", false},
+		{"env:MAUMIRROR_TEST_SECRET", "from env", "env:MAUMIRROR_TEST_SECRET", false},
+		{"env:MAUMIRROR_TEST_MISSING", "", "", true},
+		{"file:" + path, "from file", "file:" + path, false},
+		{"file:" + path + ".missing", "", "", true},
+	}
+	for _, test := range tests {
+		secret, err := ParseSecret(test.raw)
+		if (err != nil) != test.wantErr {
+			t.Errorf("ParseSecret(%q) returned error %v, expected error: %t", test.raw, err, test.wantErr)
+		} else if !test.wantErr && (secret.Value != test.wantValue || secret.Ref != test.wantRef) {
+			t.Errorf("ParseSecret(%q) = %+v, expected value %q and ref %q", test.raw, secret, test.wantValue, test.wantRef)
+		}
+	}
+}
+
+func TestSecretMarshalPreservesReference(t *testing.T) {
+	t.Setenv("MAUMIRROR_TEST_SECRET", "from env")
+	type wrapper struct {
+		Secret Secret `yaml:"secret" json:"secret"`
+	}
+	for _, raw := range []string{"plaintext", "env:MAUMIRROR_TEST_SECRET"} {
+		var parsed wrapper
+		if err := yaml.Unmarshal([]byte("secret: "+raw+"\n"), &parsed); err != nil {
+			t.Fatalf("failed to unmarshal %q: %v", raw, err)
+		}
+		out, err := yaml.Marshal(&parsed)
+		if err != nil {
+			t.Fatal(err)
+		} else if string(out) != "secret: "+raw+"\n" {
+			t.Errorf("YAML round trip of %q produced %q", raw, out)
+		}
+		jsonOut, err := json.Marshal(&parsed)
+		if err != nil {
+			t.Fatal(err)
+		} else if expected, _ := json.Marshal(map[string]string{"secret": raw}); string(jsonOut) != string(expected) {
+			t.Errorf("JSON marshal of %q produced %s, expected %s", raw, jsonOut, expected)
+		}
+	}
+}
+
+func TestSecretUnmarshalJSONDoesNotResolveReferences(t *testing.T) {
+	t.Setenv("MAUMIRROR_TEST_SECRET", "from env")
+	var secret Secret
+	if err := json.Unmarshal([]byte(`"env:MAUMIRROR_TEST_SECRET"`), &secret); err != nil {
+		t.Fatal(err)
+	} else if secret.Value != "env:MAUMIRROR_TEST_SECRET" || secret.Ref != "" {
+		t.Errorf("JSON secret was parsed as %+v, expected the reference to be kept as a plaintext value", secret)
+	}
+}
+
+func TestSecretRedacted(t *testing.T) {
+	tests := []struct {
+		in       Secret
+		expected Secret
+	}{
+		{Secret{Value: "hunter2"}, Secret{Value: "********"}},
+		{Secret{Ref: "env:FOO", Value: "hunter2"}, Secret{Ref: "env:FOO"}},
+		{Secret{}, Secret{}},
+	}
+	for _, test := range tests {
+		if redacted := test.in.Redacted(); redacted != test.expected {
+			t.Errorf("%+v.Redacted() = %+v, expected %+v", test.in, redacted, test.expected)
+		}
+	}
+}
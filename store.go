@@ -0,0 +1,533 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+	"gopkg.in/yaml.v3"
+	log "maunium.net/go/maulogger/v2"
+)
+
+var (
+	bucketRepositories   = []byte("repositories")
+	bucketCIRepositories = []byte("ci_repositories")
+	bucketCheckSuites    = []byte("check_suites")
+	bucketCheckRuns      = []byte("check_runs")
+	bucketRuns           = []byte("runs")
+	bucketDeliveries     = []byte("deliveries")
+	bucketDeployments    = []byte("deployments")
+
+	allBuckets = [][]byte{bucketRepositories, bucketCIRepositories, bucketCheckSuites, bucketCheckRuns, bucketRuns, bucketDeliveries, bucketDeployments}
+)
+
+const (
+	// Number of mirror runs to keep per repository.
+	runHistoryLength = 50
+	// Number of webhook deliveries to keep.
+	deliveryHistoryLength = 1000
+	// How long check suite and check run IDs are remembered after their last update.
+	ciMappingMaxAge = 30 * 24 * time.Hour
+)
+
+var ErrDatabaseLocked = errors.New("database is locked by another process (use --url to manage a running instance)")
+
+var store *bolt.DB
+
+func (cfg *Config) databasePath() string {
+	if len(cfg.Database) > 0 {
+		return cfg.Database
+	}
+	return filepath.Join(cfg.DataDir, "maumirror.db")
+}
+
+func openDatabase(path string, readOnly bool) (*bolt.DB, error) {
+	// bolt creates the file even in read-only mode, and then fails to initialize it
+	if readOnly {
+		if _, err := os.Stat(path); err != nil {
+			return nil, err
+		}
+	}
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: time.Second, ReadOnly: readOnly})
+	if errors.Is(err, bolt.ErrTimeout) {
+		return nil, ErrDatabaseLocked
+	} else if err != nil || readOnly {
+		return db, err
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, bucket := range allBuckets {
+			if _, err := tx.CreateBucketIfNotExists(bucket); err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		_ = db.Close()
+		return nil, fmt.Errorf("failed to create buckets: %w", err)
+	}
+	return db, nil
+}
+
+// initStore opens the database, imports any repositories defined in the config file
+// and loads the stored repositories into the config struct.
+func initStore() (err error, code int) {
+	if store, err = openDatabase(config.databasePath(), false); err != nil {
+		return fmt.Errorf("failed to open database: %w", err), 13
+	} else if err = importConfigRepositories(); err != nil {
+		return fmt.Errorf("failed to import repositories from config: %w", err), 14
+	}
+	var repos map[string]*Repository
+	var ciRepos map[int64]*CIRepository
+	if repos, ciRepos, err = readStoredRepositories(store); err != nil {
+		return fmt.Errorf("failed to load repositories from database: %w", err), 13
+	}
+	for name, repo := range repos {
+		repo.Name = name
+		repo.Log = log.Sub(name)
+	}
+	for projectID, repo := range ciRepos {
+		repo.projectID = projectID
+		repo.plock = NewPartitionLocker(&sync.Mutex{})
+		if err = repo.compile(); err != nil {
+			return fmt.Errorf("failed to load CI repository %d: %w", projectID, err), 13
+		}
+	}
+	config.Repositories = repos
+	config.CIRepositories = ciRepos
+	return nil, 0
+}
+
+func readStoredRepositories(db *bolt.DB) (repos map[string]*Repository, ciRepos map[int64]*CIRepository, err error) {
+	repos = make(map[string]*Repository)
+	ciRepos = make(map[int64]*CIRepository)
+	err = db.View(func(tx *bolt.Tx) error {
+		if bucket := tx.Bucket(bucketRepositories); bucket != nil {
+			err := bucket.ForEach(func(key, value []byte) error {
+				var repo Repository
+				if err := yaml.Unmarshal(value, &repo); err != nil {
+					return fmt.Errorf("failed to parse repository %s: %w", key, err)
+				}
+				repos[string(key)] = &repo
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+		}
+		if bucket := tx.Bucket(bucketCIRepositories); bucket != nil {
+			return bucket.ForEach(func(key, value []byte) error {
+				projectID, err := strconv.ParseInt(string(key), 10, 64)
+				if err != nil {
+					return fmt.Errorf("invalid CI repository key %s: %w", key, err)
+				}
+				var repo CIRepository
+				if err = yaml.Unmarshal(value, &repo); err != nil {
+					return fmt.Errorf("failed to parse CI repository %d: %w", projectID, err)
+				}
+				ciRepos[projectID] = &repo
+				return nil
+			})
+		}
+		return nil
+	})
+	return
+}
+
+// importConfigRepositories moves repositories defined in the config file into the database and removes them
+// from the config file. Entries that already exist in the database are left in the config file untouched.
+func importConfigRepositories() error {
+	if len(config.Repositories) == 0 && len(config.CIRepositories) == 0 {
+		return nil
+	}
+	var importedRepos []string
+	var importedCIRepos []int64
+	err := store.Update(func(tx *bolt.Tx) error {
+		bucket := tx.Bucket(bucketRepositories)
+		for name, repo := range config.Repositories {
+			if bucket.Get([]byte(name)) != nil {
+				log.Warnfln("Repository %s in the config file already exists in the database, ignoring config entry", name)
+				continue
+			} else if data, err := yaml.Marshal(repo); err != nil {
+				return fmt.Errorf("failed to marshal repository %s: %w", name, err)
+			} else if err = bucket.Put([]byte(name), data); err != nil {
+				return err
+			}
+			importedRepos = append(importedRepos, name)
+		}
+		bucket = tx.Bucket(bucketCIRepositories)
+		for projectID, repo := range config.CIRepositories {
+			key := []byte(strconv.FormatInt(projectID, 10))
+			if bucket.Get(key) != nil {
+				log.Warnfln("CI repository %d in the config file already exists in the database, ignoring config entry", projectID)
+				continue
+			} else if data, err := yaml.Marshal(repo); err != nil {
+				return fmt.Errorf("failed to marshal CI repository %d: %w", projectID, err)
+			} else if err = bucket.Put(key, data); err != nil {
+				return err
+			}
+			importedCIRepos = append(importedCIRepos, projectID)
+		}
+		return nil
+	})
+	if err != nil || len(importedRepos) == 0 && len(importedCIRepos) == 0 {
+		return err
+	}
+	log.Infofln("Imported %d repositories and %d CI repositories from the config file into the database", len(importedRepos), len(importedCIRepos))
+
+	configLock.Lock()
+	defer configLock.Unlock()
+	for _, name := range importedRepos {
+		delete(config.Repositories, name)
+	}
+	for _, projectID := range importedCIRepos {
+		delete(config.CIRepositories, projectID)
+	}
+	if err = writeConfig(*configPath, &config); err != nil {
+		log.Warnln("Failed to remove imported repositories from the config file:", err)
+	}
+	return nil
+}
+
+func putRepository(repo *Repository) error {
+	data, err := yaml.Marshal(repo)
+	if err != nil {
+		return fmt.Errorf("failed to marshal repository: %w", err)
+	}
+	err = store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketRepositories).Put([]byte(repo.Name), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save repository: %w", err)
+	}
+	configLock.Lock()
+	config.Repositories[repo.Name] = repo
+	configLock.Unlock()
+	return nil
+}
+
+func deleteRepository(name string) error {
+	err := store.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(bucketRepositories).Delete([]byte(name)); err != nil {
+			return err
+		} else if runs := tx.Bucket(bucketRuns); runs.Bucket([]byte(name)) != nil {
+			return runs.DeleteBucket([]byte(name))
+		}
+		return nil
+	})
+	if err != nil {
+		return fmt.Errorf("failed to delete repository: %w", err)
+	}
+	configLock.Lock()
+	delete(config.Repositories, name)
+	configLock.Unlock()
+	return nil
+}
+
+// compile compiles the job rules and output templates of a CI repository.
+// It must be called whenever a CI repository is loaded or stored.
+func (repo *CIRepository) compile() error {
+	if err := repo.Jobs.compile(); err != nil {
+		return fmt.Errorf("invalid job rules: %w", err)
+	} else if err = repo.Output.compile(); err != nil {
+		return fmt.Errorf("invalid output templates: %w", err)
+	}
+	return nil
+}
+
+func putCIRepository(projectID int64, repo *CIRepository) error {
+	if err := repo.compile(); err != nil {
+		return err
+	}
+	data, err := yaml.Marshal(repo)
+	if err != nil {
+		return fmt.Errorf("failed to marshal CI repository: %w", err)
+	}
+	err = store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucketCIRepositories).Put([]byte(strconv.FormatInt(projectID, 10)), data)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to save CI repository: %w", err)
+	}
+	repo.projectID = projectID
+	configLock.Lock()
+	config.CIRepositories[projectID] = repo
+	configLock.Unlock()
+	return nil
+}
+
+func getRepository(name string) (*Repository, bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	repo, ok := config.Repositories[name]
+	return repo, ok
+}
+
+func getCIRepository(projectID int64) (*CIRepository, bool) {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	repo, ok := config.CIRepositories[projectID]
+	return repo, ok
+}
+
+// getRepositories returns a copy of the repository map that can be iterated without holding the lock.
+func getRepositories() map[string]*Repository {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	repos := make(map[string]*Repository, len(config.Repositories))
+	for name, repo := range config.Repositories {
+		repos[name] = repo
+	}
+	return repos
+}
+
+// getCIRepositories returns a copy of the CI repository map that can be iterated without holding the lock.
+func getCIRepositories() map[int64]*CIRepository {
+	configLock.RLock()
+	defer configLock.RUnlock()
+	repos := make(map[int64]*CIRepository, len(config.CIRepositories))
+	for projectID, repo := range config.CIRepositories {
+		repos[projectID] = repo
+	}
+	return repos
+}
+
+type ciMapping struct {
+	ID        int64     `json:"id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func (repo *CIRepository) getStoredMapping(bucket []byte, key string) (id int64, ok bool) {
+	err := store.View(func(tx *bolt.Tx) error {
+		data := tx.Bucket(bucket).Get([]byte(fmt.Sprintf("%d/%s", repo.projectID, key)))
+		if data == nil {
+			return nil
+		}
+		var mapping ciMapping
+		if err := json.Unmarshal(data, &mapping); err != nil {
+			return err
+		}
+		id, ok = mapping.ID, true
+		return nil
+	})
+	if err != nil {
+		log.Warnfln("Failed to read %s/%s from %s: %v", repo.Owner, repo.Name, bucket, err)
+	}
+	return
+}
+
+func (repo *CIRepository) putStoredMapping(bucket []byte, key string, id int64) {
+	data, _ := json.Marshal(&ciMapping{ID: id, UpdatedAt: time.Now()})
+	err := store.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(bucket).Put([]byte(fmt.Sprintf("%d/%s", repo.projectID, key)), data)
+	})
+	if err != nil {
+		log.Warnfln("Failed to save %s/%s to %s: %v", repo.Owner, repo.Name, bucket, err)
+	}
+}
+
+func (repo *CIRepository) getCheckSuiteID(sha string) (int64, bool) {
+	key := fmt.Sprintf("%d/%s", repo.projectID, sha)
+	id, ok := checkSuiteCache.Get(key)
+	if !ok {
+		if id, ok = repo.getStoredMapping(bucketCheckSuites, sha); ok {
+			atomic.AddUint64(&ciMappingStoreHits, 1)
+			checkSuiteCache.Set(key, id)
+		}
+	}
+	return id, ok
+}
+
+func (repo *CIRepository) setCheckSuiteID(sha string, id int64) {
+	checkSuiteCache.Set(fmt.Sprintf("%d/%s", repo.projectID, sha), id)
+	repo.putStoredMapping(bucketCheckSuites, sha, id)
+}
+
+// getCheckRunID returns the ID of the check run with the given external ID (the job ID, or pipelineExternalID for pipelines).
+func (repo *CIRepository) getCheckRunID(externalID string) (int64, bool) {
+	key := fmt.Sprintf("%d/%s", repo.projectID, externalID)
+	id, ok := checkRunCache.Get(key)
+	if !ok {
+		if id, ok = repo.getStoredMapping(bucketCheckRuns, externalID); ok {
+			atomic.AddUint64(&ciMappingStoreHits, 1)
+			checkRunCache.Set(key, id)
+		}
+	}
+	return id, ok
+}
+
+func (repo *CIRepository) setCheckRunID(externalID string, id int64) {
+	checkRunCache.Set(fmt.Sprintf("%d/%s", repo.projectID, externalID), id)
+	repo.putStoredMapping(bucketCheckRuns, externalID, id)
+}
+
+// pruneCIMappings removes check suite, check run and deployment IDs that haven't been updated in ciMappingMaxAge.
+func pruneCIMappings() {
+	cutoff := time.Now().Add(-ciMappingMaxAge)
+	var pruned int
+	err := store.Update(func(tx *bolt.Tx) error {
+		for _, bucketName := range [][]byte{bucketCheckSuites, bucketCheckRuns, bucketDeployments} {
+			cursor := tx.Bucket(bucketName).Cursor()
+			for key, value := cursor.First(); key != nil; key, value = cursor.Next() {
+				var mapping ciMapping
+				if err := json.Unmarshal(value, &mapping); err == nil && mapping.UpdatedAt.After(cutoff) {
+					continue
+				} else if err = cursor.Delete(); err != nil {
+					return err
+				}
+				pruned++
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Warnln("Failed to prune old CI mappings:", err)
+	} else if pruned > 0 {
+		log.Debugfln("Pruned %d old CI mappings", pruned)
+	}
+}
+
+func pruneCIMappingsLoop() {
+	for {
+		pruneCIMappings()
+		checkSuiteCache.RemoveExpired()
+		checkRunCache.RemoveExpired()
+		time.Sleep(1 * time.Hour)
+	}
+}
+
+func sequenceKey(seq uint64) []byte {
+	key := make([]byte, 8)
+	binary.BigEndian.PutUint64(key, seq)
+	return key
+}
+
+// appendHistory adds an entry to a bucket used as a ring buffer, dropping the oldest entries beyond maxLength.
+func appendHistory(bucket *bolt.Bucket, maxLength uint64, data []byte) error {
+	seq, err := bucket.NextSequence()
+	if err != nil {
+		return err
+	} else if err = bucket.Put(sequenceKey(seq), data); err != nil {
+		return err
+	} else if seq > maxLength {
+		return bucket.Delete(sequenceKey(seq - maxLength))
+	}
+	return nil
+}
+
+// readHistory returns the raw entries of a history bucket, newest first.
+func readHistory(bucket *bolt.Bucket) (entries []json.RawMessage) {
+	if bucket == nil {
+		return
+	}
+	cursor := bucket.Cursor()
+	for key, value := cursor.Last(); key != nil; key, value = cursor.Prev() {
+		entries = append(entries, append(json.RawMessage{}, value...))
+	}
+	return
+}
+
+type RunRecord struct {
+	Trigger    string        `json:"trigger"`
+	StatusCode int           `json:"status_code"`
+	Result     *MirrorResult `json:"result"`
+}
+
+// recordRun saves the result of a mirror run in the repository's run history.
+func recordRun(repo *Repository, trigger string, res *MirrorResult) {
+	data, _ := json.Marshal(&RunRecord{Trigger: trigger, StatusCode: res.StatusCode, Result: res})
+	err := store.Update(func(tx *bolt.Tx) error {
+		bucket, err := tx.Bucket(bucketRuns).CreateBucketIfNotExists([]byte(repo.Name))
+		if err != nil {
+			return err
+		}
+		return appendHistory(bucket, runHistoryLength, data)
+	})
+	if err != nil {
+		repo.Log.Warnln("Failed to save run history:", err)
+	}
+}
+
+func getRunHistory(name string) (runs []json.RawMessage, err error) {
+	err = store.View(func(tx *bolt.Tx) error {
+		runs = readHistory(tx.Bucket(bucketRuns).Bucket([]byte(name)))
+		return nil
+	})
+	return
+}
+
+type Delivery struct {
+	ID         string    `json:"id"`
+	Source     string    `json:"source"`
+	Event      string    `json:"event"`
+	Repository string    `json:"repository,omitempty"`
+	ReceivedAt time.Time `json:"received_at"`
+	StatusCode int       `json:"status_code"`
+}
+
+// deliveryRecorder is a http.ResponseWriter that records the webhook delivery in the database once the response is sent.
+type deliveryRecorder struct {
+	http.ResponseWriter
+	Delivery
+}
+
+func newDeliveryRecorder(w http.ResponseWriter, source, id, event string) *deliveryRecorder {
+	return &deliveryRecorder{
+		ResponseWriter: w,
+		Delivery: Delivery{
+			ID:         id,
+			Source:     source,
+			Event:      event,
+			ReceivedAt: time.Now(),
+			StatusCode: http.StatusOK,
+		},
+	}
+}
+
+func (rec *deliveryRecorder) WriteHeader(status int) {
+	rec.StatusCode = status
+	rec.ResponseWriter.WriteHeader(status)
+}
+
+func (rec *deliveryRecorder) save() {
+	data, _ := json.Marshal(&rec.Delivery)
+	err := store.Update(func(tx *bolt.Tx) error {
+		return appendHistory(tx.Bucket(bucketDeliveries), deliveryHistoryLength, data)
+	})
+	if err != nil {
+		log.Warnfln("Failed to save %s webhook delivery %s: %v", rec.Source, rec.ID, err)
+	}
+}
+
+func getDeliveries() (deliveries []json.RawMessage, err error) {
+	err = store.View(func(tx *bolt.Tx) error {
+		deliveries = readHistory(tx.Bucket(bucketDeliveries))
+		return nil
+	})
+	return
+}
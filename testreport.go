@@ -0,0 +1,146 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"context"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/go-playground/webhooks/v6/gitlab"
+	"github.com/google/go-github/v40/github"
+	log "maunium.net/go/maulogger/v2"
+)
+
+// The Checks API accepts at most 50 annotations per request.
+const annotationBatchSize = 50
+
+// Maximum length of annotation messages and raw details. GitHub allows 64 KB, but there's no point in showing that much.
+const maxAnnotationTextLength = 4000
+
+// truncateText cuts text to at most maxLength bytes (and therefore characters) including an ellipsis,
+// without splitting multi-byte characters.
+func truncateText(text string, maxLength int) string {
+	if len(text) <= maxLength {
+		return text
+	}
+	const ellipsis = "…"
+	return strings.ToValidUTF8(text[:maxLength-len(ellipsis)], "") + ellipsis
+}
+
+// findLineNumber tries to find the line in the given file where the test failed from a stack trace.
+func findLineNumber(file, stackTrace string) int {
+	if len(file) == 0 || len(stackTrace) == 0 {
+		return 1
+	}
+	prefix := file + ":"
+	for rest := stackTrace; ; {
+		idx := strings.Index(rest, prefix)
+		if idx < 0 {
+			return 1
+		}
+		rest = rest[idx+len(prefix):]
+		digits := 0
+		for digits < len(rest) && rest[digits] >= '0' && rest[digits] <= '9' {
+			digits++
+		}
+		if line, err := strconv.Atoi(rest[:digits]); err == nil && line >= 1 {
+			return line
+		}
+	}
+}
+
+func makeTestCaseAnnotation(testCase *GLTestCase) *github.CheckRunAnnotation {
+	path := testCase.File
+	if len(path) == 0 {
+		path = strings.ReplaceAll(testCase.Classname, ".", "/")
+	}
+	line := findLineNumber(testCase.File, testCase.StackTrace)
+	message := testCase.SystemOutput
+	if len(message) == 0 {
+		message = fmt.Sprintf("Test %s", testCase.Status)
+	}
+	annotation := &github.CheckRunAnnotation{
+		Path:            &path,
+		StartLine:       &line,
+		EndLine:         &line,
+		AnnotationLevel: stringPtr("failure"),
+		Message:         stringPtr(truncateText(message, maxAnnotationTextLength)),
+		Title:           stringPtr(strings.TrimPrefix(testCase.Classname+"."+testCase.Name, ".")),
+	}
+	if len(testCase.StackTrace) > 0 {
+		annotation.RawDetails = stringPtr(truncateText(testCase.StackTrace, maxAnnotationTextLength))
+	}
+	return annotation
+}
+
+// getTestFailureAnnotations returns annotations for the failed test cases in the test suite of the given job.
+// GitLab names test suites after the job that produced the report.
+func getTestFailureAnnotations(repo *CIRepository, evt *gitlab.JobEventPayload) ([]*github.CheckRunAnnotation, error) {
+	gl, err := repo.gitlabClient()
+	if err != nil {
+		return nil, err
+	}
+	report, err := gl.GetPipelineTestReport(evt.ProjectID, evt.PipelineID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get test report: %w", err)
+	}
+	var annotations []*github.CheckRunAnnotation
+	for _, suite := range report.TestSuites {
+		if suite.Name != evt.BuildName {
+			continue
+		}
+		for i := range suite.TestCases {
+			if suite.TestCases[i].Status == "failed" || suite.TestCases[i].Status == "error" {
+				annotations = append(annotations, makeTestCaseAnnotation(&suite.TestCases[i]))
+			}
+		}
+	}
+	return annotations, nil
+}
+
+// addTestFailureAnnotations adds annotations for failed tests to a completed check run in batches.
+// The check run options are the ones the run was created or updated with, so that the batches don't change anything else.
+func addTestFailureAnnotations(cli *github.Client, repo *CIRepository, evt *gitlab.JobEventPayload, runID int64, opts github.CreateCheckRunOptions) {
+	annotations, err := getTestFailureAnnotations(repo, evt)
+	if err != nil {
+		log.Warnfln("Failed to get test failures of job %d in %d: %v", evt.BuildID, evt.ProjectID, err)
+		return
+	} else if len(annotations) == 0 {
+		return
+	}
+	for start := 0; start < len(annotations); start += annotationBatchSize {
+		end := start + annotationBatchSize
+		if end > len(annotations) {
+			end = len(annotations)
+		}
+		update := makeUpdateFromCreate(opts)
+		update.Output = &github.CheckRunOutput{
+			Title:       opts.Output.Title,
+			Summary:     opts.Output.Summary,
+			Text:        opts.Output.Text,
+			Annotations: annotations[start:end],
+		}
+		_, _, err = cli.Checks.UpdateCheckRun(context.Background(), repo.Owner, repo.Name, runID, update)
+		if err != nil {
+			log.Warnfln("Failed to add test failure annotations %d-%d of job %d to check run %d in %s/%s: %v", start, end, evt.BuildID, runID, repo.Owner, repo.Name, err)
+			return
+		}
+	}
+	log.Debugfln("Added %d test failure annotations to check run %d in %s/%s", len(annotations), runID, repo.Owner, repo.Name)
+}
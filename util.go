@@ -31,17 +31,21 @@ import (
 )
 
 func checkGLToken(r *http.Request, projectID int64) (repo *CIRepository, err error, code int) {
-	repo, ok := config.CIRepositories[projectID]
+	repo, ok := getCIRepository(projectID)
 	if !ok {
 		code = http.StatusNotFound
 		err = errors.New("unknown repository")
 		return
 	}
 	token := r.Header.Get("X-Gitlab-Token")
-	if token != repo.Secret {
+	if token != repo.Secret.Value {
 		code = http.StatusUnauthorized
 		err = gitlab.ErrGitLabTokenVerificationFailed
 		return
+	} else if !repo.usesCommitStatuses() && appTransport == nil {
+		code = http.StatusServiceUnavailable
+		err = errors.New("repository uses the checks mode, but the GitHub app is not configured")
+		return
 	}
 	return repo, nil, http.StatusOK
 }
@@ -53,13 +57,13 @@ func checkSig(r *http.Request, repoName string) (repo *Repository, err error, co
 		err = github.ErrMissingHubSignatureHeader
 		return
 	}
-	repo, ok := config.Repositories[repoName]
+	repo, ok := getRepository(repoName)
 	if !ok {
 		code = http.StatusNotFound
 		err = errors.New("unknown repository")
 		return
 	}
-	mac := hmac.New(sha1.New, []byte(repo.Secret))
+	mac := hmac.New(sha1.New, []byte(repo.Secret.Value))
 
 	payload, err := io.ReadAll(r.Body)
 	if err != nil || len(payload) == 0 {
@@ -0,0 +1,466 @@
+// maumirror - A GitHub repo mirroring system using webhooks.
+// Copyright (C) 2021 Tulir Asokan
+//
+// This program is free software: you can redistribute it and/or modify
+// it under the terms of the GNU Affero General Public License as published by
+// the Free Software Foundation, either version 3 of the License, or
+// (at your option) any later version.
+//
+// This program is distributed in the hope that it will be useful,
+// but WITHOUT ANY WARRANTY; without even the implied warranty of
+// MERCHANTABILITY or FITNESS FOR A PARTICULAR PURPOSE.  See the
+// GNU Affero General Public License for more details.
+//
+// You should have received a copy of the GNU Affero General Public License
+// along with this program.  If not, see <https://www.gnu.org/licenses/>.
+
+package main
+
+import (
+	"crypto/rsa"
+	"crypto/x509"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+type ValidationReport struct {
+	Errors   []string
+	Warnings []string
+}
+
+func (report *ValidationReport) errorf(field, format string, args ...interface{}) {
+	report.Errors = append(report.Errors, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (report *ValidationReport) warnf(field, format string, args ...interface{}) {
+	report.Warnings = append(report.Warnings, fmt.Sprintf("%s: %s", field, fmt.Sprintf(format, args...)))
+}
+
+func (report *ValidationReport) Print(path string) {
+	sort.Strings(report.Errors)
+	sort.Strings(report.Warnings)
+	fmt.Printf("%s: %d errors, %d warnings\n", path, len(report.Errors), len(report.Warnings))
+	for _, err := range report.Errors {
+		fmt.Println("  error:  ", err)
+	}
+	for _, warn := range report.Warnings {
+		fmt.Println("  warning:", warn)
+	}
+}
+
+func validateCommand() int {
+	data, err := os.ReadFile(*configPath)
+	if err != nil {
+		fmt.Printf("%s: failed to read config: %v\n", *configPath, err)
+		return 2
+	}
+	var cfg Config
+	if err = yaml.Unmarshal(data, &cfg); err != nil {
+		fmt.Printf("%s: failed to parse config: %v\n", *configPath, err)
+		return 2
+	}
+	report := validateConfig(&cfg)
+	validateStoredRepositories(report, &cfg)
+	report.Print(*configPath)
+	if len(report.Errors) > 0 {
+		return 1
+	}
+	return 0
+}
+
+// validateStoredRepositories validates the repositories in the database, if it isn't in use by a running instance.
+func validateStoredRepositories(report *ValidationReport, cfg *Config) {
+	db, err := openDatabase(cfg.databasePath(), true)
+	if errors.Is(err, os.ErrNotExist) {
+		return
+	} else if err != nil {
+		report.warnf("database", "skipped checking stored repositories: %v", err)
+		return
+	}
+	repos, ciRepos, err := readStoredRepositories(db)
+	_ = db.Close()
+	if err != nil {
+		report.errorf("database", "%v", err)
+		return
+	}
+	for name := range repos {
+		if _, ok := cfg.Repositories[name]; ok {
+			report.warnf("repositories."+name, "already exists in the database, the config entry will not be imported")
+		}
+	}
+	for projectID := range ciRepos {
+		if _, ok := cfg.CIRepositories[projectID]; ok {
+			report.warnf(fmt.Sprintf("ci_repositories.%d", projectID), "already exists in the database, the config entry will not be imported")
+		}
+	}
+	validateRepositories(report, cfg, "database.", repos, ciRepos)
+}
+
+var scpLikeURLRegex = regexp.MustCompile(`^(?:[^@/]+@)?[^:/]+:[^/].*$`)
+
+func validateGitURL(report *ValidationReport, field, value string) {
+	if strings.Contains(value, "://") {
+		parsed, err := url.Parse(value)
+		if err != nil {
+			report.errorf(field, "invalid URL: %v", err)
+			return
+		}
+		switch parsed.Scheme {
+		case "ssh", "git", "http", "https":
+			if len(parsed.Host) == 0 {
+				report.errorf(field, "URL %q doesn't have a host", value)
+			}
+		case "file":
+		default:
+			report.errorf(field, "unsupported URL scheme %q", parsed.Scheme)
+		}
+	} else if !scpLikeURLRegex.MatchString(value) {
+		report.errorf(field, "%q is not a valid git URL", value)
+	}
+}
+
+func validateHTTPURL(report *ValidationReport, field, value string) {
+	parsed, err := url.Parse(value)
+	if err != nil {
+		report.errorf(field, "invalid URL: %v", err)
+	} else if parsed.Scheme != "http" && parsed.Scheme != "https" {
+		report.errorf(field, "URL %q must use http or https", value)
+	} else if len(parsed.Host) == 0 {
+		report.errorf(field, "URL %q doesn't have a host", value)
+	}
+}
+
+func expandHome(path string) string {
+	if strings.HasPrefix(path, "~/") {
+		home, _ := os.UserHomeDir()
+		return filepath.Join(home, path[2:])
+	}
+	return path
+}
+
+func validateKeyFile(report *ValidationReport, field, path string) {
+	info, err := os.Stat(expandHome(path))
+	if err != nil {
+		report.errorf(field, "%v", err)
+	} else if !info.Mode().IsRegular() {
+		report.errorf(field, "%s is not a regular file", path)
+	} else if info.Mode().Perm()&0077 != 0 {
+		report.errorf(field, "%s is accessible by other users (mode %#o), ssh will refuse to use it", path, info.Mode().Perm())
+	}
+}
+
+func validateGitHubAppKey(report *ValidationReport, key string) {
+	block, _ := pem.Decode([]byte(key))
+	if block == nil {
+		report.errorf("github_app.private_key", "not a PEM encoded key")
+		return
+	}
+	if _, err := x509.ParsePKCS1PrivateKey(block.Bytes); err == nil {
+		return
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		report.errorf("github_app.private_key", "failed to parse RSA private key: %v", err)
+	} else if _, ok := parsed.(*rsa.PrivateKey); !ok {
+		report.errorf("github_app.private_key", "GitHub app keys must be RSA keys, got %T", parsed)
+	}
+}
+
+func validateEndpoints(report *ValidationReport, cfg *Config) {
+	endpoints := map[string]string{
+		"server.webhook_endpoint": cfg.Server.WebhookEndpoint,
+	}
+	if len(cfg.Server.CIWebhookEndpoint) > 0 {
+		endpoints["server.ci_webhook_endpoint"] = cfg.Server.CIWebhookEndpoint
+	}
+	if len(cfg.Server.CIStatusEndpoint) > 0 {
+		endpoints["server.ci_status_endpoint"] = cfg.Server.CIStatusEndpoint
+	}
+	if len(cfg.Server.GitHubCIWebhookEndpoint) > 0 {
+		endpoints["server.github_ci_webhook_endpoint"] = cfg.Server.GitHubCIWebhookEndpoint
+	}
+	if len(cfg.Server.AppWebhookEndpoint) > 0 {
+		endpoints["server.app_webhook_endpoint"] = cfg.Server.AppWebhookEndpoint
+	}
+	if len(cfg.Server.AdminEndpoint) > 0 {
+		for path := range adminHandlers {
+			endpoints["server.admin_endpoint ("+path+")"] = fmt.Sprintf("%s/%s", cfg.Server.AdminEndpoint, path)
+		}
+	}
+	fields := make([]string, 0, len(endpoints))
+	for field, path := range endpoints {
+		fields = append(fields, field)
+		if !strings.HasPrefix(path, "/") {
+			report.errorf(field, "endpoint %q must start with a slash", path)
+		}
+	}
+	sort.Strings(fields)
+	for i, field := range fields {
+		for _, otherField := range fields[i+1:] {
+			path, otherPath := endpoints[field], endpoints[otherField]
+			if path == otherPath {
+				report.errorf(field, "endpoint %q collides with %s", path, otherField)
+			} else if strings.HasSuffix(path, "/") && strings.HasPrefix(otherPath, path) {
+				report.errorf(field, "endpoint %q shadows %s (%q)", path, otherField, otherPath)
+			} else if strings.HasSuffix(otherPath, "/") && strings.HasPrefix(path, otherPath) {
+				report.errorf(otherField, "endpoint %q shadows %s (%q)", otherPath, field, path)
+			}
+		}
+	}
+}
+
+func validateConfig(cfg *Config) *ValidationReport {
+	report := &ValidationReport{}
+
+	if len(cfg.DataDir) == 0 {
+		report.errorf("datadir", "is required")
+	} else if info, err := os.Stat(cfg.DataDir); err != nil {
+		report.errorf("datadir", "%v", err)
+	} else if !info.IsDir() {
+		report.errorf("datadir", "%s is not a directory", cfg.DataDir)
+	}
+
+	if len(cfg.Server.Address) == 0 {
+		report.errorf("server.address", "is required")
+	}
+	if len(cfg.Server.WebhookEndpoint) == 0 {
+		report.errorf("server.webhook_endpoint", "is required")
+	}
+	validateEndpoints(report, cfg)
+	if len(cfg.Server.WebhookPublicURL) > 0 {
+		validateHTTPURL(report, "server.webhook_public_url", cfg.Server.WebhookPublicURL)
+	}
+	if len(cfg.Server.CIWebhookPublicURL) > 0 {
+		validateHTTPURL(report, "server.ci_webhook_public_url", cfg.Server.CIWebhookPublicURL)
+	}
+	if len(cfg.Server.AdminEndpoint) > 0 && len(cfg.Server.AdminSecret.Value) == 0 {
+		report.warnf("server.admin_secret", "admin API is enabled without a secret")
+	}
+
+	if len(cfg.GitHubApp.PrivateKey.Value) > 0 {
+		if cfg.GitHubApp.ID == 0 {
+			report.errorf("github_app.id", "is required when a private key is set")
+		}
+		validateGitHubAppKey(report, cfg.GitHubApp.PrivateKey.Value)
+		if len(cfg.Server.CIWebhookEndpoint) == 0 {
+			report.warnf("server.ci_webhook_endpoint", "GitHub app is configured, but CI webhook endpoint is not set")
+		}
+		if len(cfg.Server.AppWebhookEndpoint) > 0 && len(cfg.GitHubApp.WebhookSecret.Value) == 0 {
+			report.errorf("github_app.webhook_secret", "is required when the app webhook endpoint is set")
+		}
+	}
+
+	if cfg.CICache.Size < 0 || cfg.CICache.TTL < 0 {
+		report.errorf("ci_cache", "size and ttl must not be negative")
+	}
+	if cfg.CIReconcile.Window < 0 {
+		report.errorf("ci_reconcile.window", "must not be negative")
+	}
+
+	if len(cfg.Shell.Command) == 0 {
+		report.errorf("shell.command", "is required")
+	} else if _, err := exec.LookPath(cfg.Shell.Command); err != nil {
+		report.errorf("shell.command", "%v", err)
+	}
+	if cfg.Shell.Scripts.Push != nil && len(cfg.Shell.Scripts.Push.Path) > 0 && len(cfg.Shell.Scripts.Push.Data) == 0 {
+		report.warnf("shell.scripts.push", "%s is empty, the built-in script will be used", cfg.Shell.Scripts.Push.Path)
+	}
+	if cfg.Shell.Timeout < 0 {
+		report.errorf("shell.timeout", "must not be negative")
+	}
+	if cfg.Shell.Limits.CPUTime < 0 || cfg.Shell.Limits.Memory < 0 {
+		report.errorf("shell.limits", "limits must not be negative")
+	}
+
+	switch cfg.SSH.HostKeyMode {
+	case "", HostKeyModeStrict, HostKeyModeTOFU:
+	default:
+		report.errorf("ssh.host_key_mode", "unknown mode %q", cfg.SSH.HostKeyMode)
+	}
+	for host, keys := range cfg.SSH.HostKeys {
+		for _, key := range keys {
+			if _, err := parsePinnedHostKey(host, key); err != nil {
+				report.errorf("ssh.host_keys."+host, "%v", err)
+			}
+		}
+	}
+
+	validateRepositories(report, cfg, "", cfg.Repositories, cfg.CIRepositories)
+	validateGitHubCIRepositories(report, cfg)
+	return report
+}
+
+func validateGitHubCIRepositories(report *ValidationReport, cfg *Config) {
+	if len(cfg.GitHubCIRepositories) > 0 && len(cfg.Server.GitHubCIWebhookEndpoint) == 0 {
+		report.warnf("server.github_ci_webhook_endpoint", "GitHub CI repositories are configured, but the GitHub CI webhook endpoint is not set")
+	}
+	for name, repo := range cfg.GitHubCIRepositories {
+		field := "github_ci_repositories." + name
+		if repo == nil {
+			report.errorf(field, "is empty")
+			continue
+		}
+		if parts := strings.Split(name, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			report.errorf(field, "name must be in owner/name format")
+		}
+		if len(repo.Secret.Value) == 0 {
+			report.errorf(field+".secret", "is required for verifying webhook signatures")
+		}
+		if repo.ProjectID <= 0 {
+			report.errorf(field+".project_id", "is required")
+		}
+		if len(repo.GitLabURL) == 0 {
+			report.errorf(field+".gitlab_url", "is required")
+		} else {
+			validateHTTPURL(report, field+".gitlab_url", repo.GitLabURL)
+		}
+		if len(repo.GitLabToken.Value) == 0 {
+			report.errorf(field+".gitlab_token", "is required")
+		}
+	}
+}
+
+func validateRepositories(report *ValidationReport, cfg *Config, prefix string, repos map[string]*Repository, ciRepos map[int64]*CIRepository) {
+	names := make([]string, 0, len(repos))
+	for name := range repos {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		repo := repos[name]
+		field := prefix + "repositories." + name
+		if parts := strings.Split(name, "/"); len(parts) != 2 || len(parts[0]) == 0 || len(parts[1]) == 0 {
+			report.errorf(field, "repository name must be in owner/name format")
+		}
+		if repo == nil {
+			report.errorf(field, "is empty")
+			continue
+		}
+		if len(repo.Target) == 0 {
+			report.errorf(field+".target", "is required")
+		} else {
+			validateGitURL(report, field+".target", repo.Target)
+		}
+		if len(repo.Source) > 0 {
+			validateGitURL(report, field+".source", repo.Source)
+		}
+		if len(repo.WikiTarget) > 0 {
+			validateGitURL(report, field+".wiki_target", repo.WikiTarget)
+			if !repo.MirrorWiki {
+				report.warnf(field+".wiki_target", "is set, but mirror_wiki is not enabled")
+			}
+		}
+		if len(repo.PushKey) > 0 {
+			validateKeyFile(report, field+".push_key", repo.PushKey)
+		}
+		if len(repo.PullKey) > 0 {
+			validateKeyFile(report, field+".pull_key", repo.PullKey)
+		}
+		if len(repo.Secret.Value) == 0 {
+			report.warnf(field+".secret", "webhook signatures can't be verified without a secret")
+		}
+		if repo.Timeout < 0 {
+			report.errorf(field+".timeout", "must not be negative")
+		}
+	}
+
+	for projectID, repo := range ciRepos {
+		field := fmt.Sprintf("%sci_repositories.%d", prefix, projectID)
+		if repo == nil {
+			report.errorf(field, "is empty")
+			continue
+		}
+		if len(repo.Owner) == 0 {
+			report.errorf(field+".owner", "is required")
+		}
+		if len(repo.Name) == 0 {
+			report.errorf(field+".repo", "is required")
+		}
+		if len(repo.Secret.Value) == 0 {
+			report.warnf(field+".secret", "GitLab webhook token is not set")
+		}
+		if len(repo.StatusToken.Value) > 0 && len(cfg.Server.CIStatusEndpoint) == 0 {
+			report.warnf(field+".status_token", "status token is set, but the CI status endpoint is not")
+		}
+		if repo.usesCommitStatuses() && (repo.LogExcerptLines > 0 || repo.TestReportAnnotations) {
+			report.warnf(field+".mode", "log excerpts and test report annotations are only supported in the checks mode")
+		}
+		switch repo.Mode {
+		case "", CIModeChecks:
+			if len(cfg.GitHubApp.PrivateKey.Value) == 0 {
+				report.warnf(field+".mode", "the checks mode requires the GitHub app, but it's not configured")
+			}
+		case CIModeStatuses:
+			if len(repo.GitHubToken.Value) == 0 {
+				report.errorf(field+".github_token", "is required in the statuses mode")
+			}
+		case CIModeGitea:
+			if len(repo.GiteaURL) == 0 {
+				report.errorf(field+".gitea_url", "is required in the gitea mode")
+			} else {
+				validateHTTPURL(report, field+".gitea_url", repo.GiteaURL)
+			}
+			if len(repo.GiteaToken.Value) == 0 {
+				report.errorf(field+".gitea_token", "is required in the gitea mode")
+			}
+		default:
+			report.errorf(field+".mode", "unknown mode %q", repo.Mode)
+		}
+		if len(repo.GitLabURL) > 0 {
+			validateHTTPURL(report, field+".gitlab_url", repo.GitLabURL)
+			if len(repo.GitLabToken.Value) == 0 {
+				report.warnf(field+".gitlab_token", "GitLab URL is set, but the access token is not")
+			}
+		}
+		if repo.LogExcerptLines < 0 {
+			report.errorf(field+".log_excerpt_lines", "must not be negative")
+		} else if repo.LogExcerptLines > 0 && (len(repo.GitLabURL) == 0 || len(repo.GitLabToken.Value) == 0) {
+			report.warnf(field+".log_excerpt_lines", "log excerpts require gitlab_url and gitlab_token")
+		}
+		if repo.TestReportAnnotations && (len(repo.GitLabURL) == 0 || len(repo.GitLabToken.Value) == 0) {
+			report.warnf(field+".test_report_annotations", "test report annotations require gitlab_url and gitlab_token")
+		}
+		if repo.PRComment && repo.Mode == CIModeGitea {
+			report.warnf(field+".pr_comment", "pull request comments are not supported in the gitea mode")
+		}
+		if repo.Deployments && repo.Mode == CIModeGitea {
+			report.warnf(field+".deployments", "deployments are not supported in the gitea mode")
+		}
+		validateJobRules(report, field+".jobs", &repo.Jobs)
+		validateOutputTemplates(report, field+".output", &repo.Output)
+	}
+}
+
+func validateJobRuleList(report *ValidationReport, field string, rules []JobRule) {
+	for i := range rules {
+		if err := rules[i].compile(); err != nil {
+			report.errorf(fmt.Sprintf("%s[%d]", field, i), "%v", err)
+		}
+	}
+}
+
+func validateJobRules(report *ValidationReport, field string, rules *JobRules) {
+	validateJobRuleList(report, field+".include", rules.Include)
+	validateJobRuleList(report, field+".exclude", rules.Exclude)
+	if len(rules.NameTemplate) > 0 && !strings.Contains(rules.NameTemplate, "{name}") && !strings.Contains(rules.NameTemplate, "{stage}") {
+		report.warnf(field+".name_template", "doesn't contain {name} or {stage}, so all jobs will have the same check run name")
+	}
+}
+
+func validateOutputTemplates(report *ValidationReport, field string, tpls *JobOutputTemplates) {
+	for _, tpl := range []struct{ name, value string }{{"title", tpls.Title}, {"summary", tpls.Summary}, {"text", tpls.Text}} {
+		if _, err := compileOutputTemplate(tpl.name, tpl.value); err != nil {
+			report.errorf(field+"."+tpl.name, "%v", err)
+		}
+	}
+}